@@ -0,0 +1,444 @@
+package greener
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotFound is returned when there is no blob with the given digest.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// ErrBlobUploadAbandoned is returned by Put when GC removed the upload because no chunk had been written for longer than its grace period.
+var ErrBlobUploadAbandoned = errors.New("blob upload was removed by GC after being idle")
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	// Digest is the hex encoded SHA-256 of the blob's content, which is also its ID.
+	Digest  string
+	Size    int64
+	Refs    int
+	Created time.Time
+}
+
+// BlobStore keeps large binary data in a BatchDB, split into chunks so that neither writing nor reading a blob needs the whole thing in memory. Blobs are content-addressed by their SHA-256 digest, so storing the same content twice only keeps one copy. Each blob has a reference count, and blobs nobody refers to are removed by GC once a grace period has passed.
+type BlobStore struct {
+	db        DB
+	table     string
+	chunkSize int
+}
+
+// NewBlobStore initializes and returns a BlobStore using the default "blob" tables and 256 KiB chunks.
+func NewBlobStore(ctx context.Context, db DB) (*BlobStore, error) {
+	return NewBlobStoreTable(ctx, db, "blob", 256*1024)
+}
+
+// NewBlobStoreTable initializes and returns a BlobStore using tables whose names start with name. The chunk size only affects blobs written from now on; existing blobs keep the size they were written with.
+func NewBlobStoreTable(ctx context.Context, db DB, name string, chunkSize int) (*BlobStore, error) {
+	if err := ValidateKVTableName(name); err != nil {
+		return nil, err
+	}
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("chunk size must be positive")
+	}
+	s := &BlobStore{db: db, table: name, chunkSize: chunkSize}
+	queries := []string{
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+		    digest TEXT PRIMARY KEY,
+		    size INTEGER NOT NULL,
+		    chunk_size INTEGER NOT NULL,
+		    refs INTEGER NOT NULL,
+		    created REAL NOT NULL,
+		    unreferenced REAL
+		);`, name),
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s_chunks (
+		    blob TEXT NOT NULL,
+		    seq INTEGER NOT NULL,
+		    data BLOB NOT NULL,
+		    PRIMARY KEY (blob, seq)
+		);`, name),
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s_uploads (
+		    id TEXT PRIMARY KEY,
+		    -- Moved forward as each chunk is written, so it is when the upload was last active
+		    started REAL NOT NULL
+		);`, name),
+	}
+	err := db.Write(func(writeDB WriteDBHandler) error {
+		for _, query := range queries {
+			if _, err := writeDB.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("failed to create blob tables %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Put streams r into the store and returns the blob's details. The caller holds one reference to the blob, which it should give up with Release when it no longer needs it. Each chunk is written in its own BatchDB write while the content is hashed, so the blob only becomes visible, under its digest, once the last chunk has been stored. An upload that fails part way leaves chunks behind that GC removes after its grace period. Writing each chunk marks the upload as active, and if GC has already removed an upload that went idle for longer than that, Put returns ErrBlobUploadAbandoned rather than storing an incomplete blob.
+func (s *BlobStore) Put(ctx context.Context, r io.Reader) (BlobInfo, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return BlobInfo{}, fmt.Errorf("failed to generate upload ID: %w", err)
+	}
+	uploadID := "upload:" + hex.EncodeToString(idBytes)
+	err := s.db.Write(func(writeDB WriteDBHandler) error {
+		_, err := writeDB.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s_uploads (id, started) VALUES (?, ?);", s.table), uploadID, timeToDB(time.Now()))
+		return err
+	})
+	if err != nil {
+		return BlobInfo{}, fmt.Errorf("failed to start upload: %w", err)
+	}
+
+	hash := sha256.New()
+	buf := make([]byte, s.chunkSize)
+	var size int64
+	for seq := 0; ; seq++ {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			size += int64(n)
+			chunk := buf[:n]
+			abandoned := false
+			err := s.db.Write(func(writeDB WriteDBHandler) error {
+				abandoned = false
+				active, err := s.touchUploadTx(ctx, writeDB, uploadID)
+				if err != nil || !active {
+					abandoned = !active
+					return err
+				}
+				_, err = writeDB.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s_chunks (blob, seq, data) VALUES (?, ?, ?);", s.table), uploadID, seq, chunk)
+				return err
+			})
+			if err != nil {
+				return BlobInfo{}, fmt.Errorf("failed to write chunk %d: %w", seq, err)
+			}
+			if abandoned {
+				return BlobInfo{}, ErrBlobUploadAbandoned
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return BlobInfo{}, fmt.Errorf("failed to read blob content: %w", readErr)
+		}
+	}
+
+	info := BlobInfo{Digest: hex.EncodeToString(hash.Sum(nil)), Size: size}
+	now := time.Now()
+	abandoned := false
+	err = s.db.Write(func(writeDB WriteDBHandler) error {
+		abandoned = false
+		// If GC has removed the upload, some of its chunks may have gone too
+		result, err := writeDB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s_uploads WHERE id = ?;", s.table), uploadID)
+		if err != nil {
+			return fmt.Errorf("failed to finish upload: %w", err)
+		}
+		if n, err := result.RowsAffected(); err != nil || n != 1 {
+			abandoned = n != 1
+			return err
+		}
+		rows, err := writeDB.QueryContext(ctx, fmt.Sprintf("SELECT refs, created FROM %s WHERE digest = ?;", s.table), info.Digest)
+		if err != nil {
+			return fmt.Errorf("error querying for blob: %w", err)
+		}
+		var created float64
+		exists := rows.Next()
+		if exists {
+			if err := rows.Scan(&info.Refs, &created); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		if exists {
+			// The content is already stored, so the uploaded chunks aren't needed
+			info.Refs++
+			info.Created = timeFromDB(created)
+			if _, err := writeDB.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET refs = refs + 1, unreferenced = NULL WHERE digest = ?;", s.table), info.Digest); err != nil {
+				return fmt.Errorf("failed to store blob: %w", err)
+			}
+			_, err = writeDB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s_chunks WHERE blob = ?;", s.table), uploadID)
+		} else {
+			info.Refs = 1
+			info.Created = timeFromDB(timeToDB(now))
+			if _, err := writeDB.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (digest, size, chunk_size, refs, created) VALUES (?, ?, ?, 1, ?);", s.table), info.Digest, size, s.chunkSize, timeToDB(now)); err != nil {
+				return fmt.Errorf("failed to store blob: %w", err)
+			}
+			_, err = writeDB.ExecContext(ctx, fmt.Sprintf("UPDATE %s_chunks SET blob = ? WHERE blob = ?;", s.table), info.Digest, uploadID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to finish upload: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	if abandoned {
+		return BlobInfo{}, ErrBlobUploadAbandoned
+	}
+	return info, nil
+}
+
+// touchUploadTx marks an upload as active inside an existing write, so GC leaves it alone for another grace period. It returns false if GC has already removed it.
+func (s *BlobStore) touchUploadTx(ctx context.Context, writeDB WriteDBHandler, uploadID string) (bool, error) {
+	result, err := writeDB.ExecContext(ctx, fmt.Sprintf("UPDATE %s_uploads SET started = ? WHERE id = ?;", s.table), timeToDB(time.Now()), uploadID)
+	if err != nil {
+		return false, fmt.Errorf("failed to mark upload as active: %w", err)
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// changeRefsTx adds delta to a blob's reference count inside an existing write, recording when it reached zero so GC can apply its grace period.
+func (s *BlobStore) changeRefsTx(ctx context.Context, writeDB WriteDBHandler, digest string, delta int) (bool, error) {
+	result, err := writeDB.ExecContext(ctx, fmt.Sprintf(`
+	    UPDATE %s SET refs = MAX(refs + ?, 0), unreferenced = CASE WHEN refs + ? <= 0 THEN ? ELSE NULL END
+	    WHERE digest = ?;
+	`, s.table), delta, delta, timeToDB(time.Now()), digest)
+	if err != nil {
+		return false, fmt.Errorf("failed to update references to blob %s: %w", digest, err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// AddRefTx adds a reference to a blob inside an existing BatchDB write, so that the reference is committed along with the data that refers to the blob. It returns false if the blob doesn't exist.
+func (s *BlobStore) AddRefTx(ctx context.Context, writeDB WriteDBHandler, digest string) (bool, error) {
+	return s.changeRefsTx(ctx, writeDB, digest, 1)
+}
+
+// ReleaseTx gives up a reference to a blob inside an existing BatchDB write. It returns false if the blob doesn't exist.
+func (s *BlobStore) ReleaseTx(ctx context.Context, writeDB WriteDBHandler, digest string) (bool, error) {
+	return s.changeRefsTx(ctx, writeDB, digest, -1)
+}
+
+func (s *BlobStore) changeRefs(ctx context.Context, digest string, delta int) error {
+	found := false
+	err := s.db.Write(func(writeDB WriteDBHandler) error {
+		var err error
+		found, err = s.changeRefsTx(ctx, writeDB, digest, delta)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrBlobNotFound
+	}
+	return nil
+}
+
+// AddRef adds a reference to a blob, or returns ErrBlobNotFound.
+func (s *BlobStore) AddRef(ctx context.Context, digest string) error {
+	return s.changeRefs(ctx, digest, 1)
+}
+
+// Release gives up a reference to a blob, or returns ErrBlobNotFound. The blob stays readable until GC removes it.
+func (s *BlobStore) Release(ctx context.Context, digest string) error {
+	return s.changeRefs(ctx, digest, -1)
+}
+
+// Stat returns the details of a blob, or ErrBlobNotFound.
+func (s *BlobStore) Stat(ctx context.Context, digest string) (BlobInfo, error) {
+	info, _, err := s.stat(ctx, digest)
+	return info, err
+}
+
+func (s *BlobStore) stat(ctx context.Context, digest string) (BlobInfo, int, error) {
+	info := BlobInfo{Digest: digest}
+	var chunkSize int
+	var created float64
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf("SELECT size, chunk_size, refs, created FROM %s WHERE digest = ?;", s.table), digest).Scan(&info.Size, &chunkSize, &info.Refs, &created)
+	if err == sql.ErrNoRows {
+		return info, 0, ErrBlobNotFound
+	}
+	if err != nil {
+		return info, 0, fmt.Errorf("error querying for blob: %w", err)
+	}
+	info.Created = timeFromDB(created)
+	return info, chunkSize, nil
+}
+
+// GC removes blobs that have had no references for longer than grace, along with unfinished uploads that haven't written a chunk for longer than grace. Each blob is removed in its own write. It returns the number of blobs removed.
+func (s *BlobStore) GC(ctx context.Context, grace time.Duration) (int, error) {
+	cutoff := timeToDB(time.Now().Add(-grace))
+	removed := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		var deleted bool
+		err := s.db.Write(func(writeDB WriteDBHandler) error {
+			deleted = false
+			// The refs check is repeated in the delete, so a reference added since the select keeps the blob
+			rows, err := writeDB.QueryContext(ctx, fmt.Sprintf(`
+			    DELETE FROM %s WHERE digest = (
+			        SELECT digest FROM %s WHERE refs = 0 AND unreferenced < ? LIMIT 1
+			    ) AND refs = 0
+			    RETURNING digest;
+			`, s.table, s.table), cutoff)
+			if err != nil {
+				return err
+			}
+			var digest string
+			if rows.Next() {
+				if err := rows.Scan(&digest); err != nil {
+					rows.Close()
+					return err
+				}
+				deleted = true
+			}
+			if err := rows.Close(); err != nil || !deleted {
+				return err
+			}
+			_, err = writeDB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s_chunks WHERE blob = ?;", s.table), digest)
+			return err
+		})
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove unreferenced blob: %w", err)
+		}
+		if !deleted {
+			break
+		}
+		removed++
+	}
+	err := s.db.Write(func(writeDB WriteDBHandler) error {
+		_, err := writeDB.ExecContext(ctx, fmt.Sprintf(`
+		    DELETE FROM %s_chunks WHERE blob IN (SELECT id FROM %s_uploads WHERE started < ?);
+		`, s.table, s.table), cutoff)
+		if err != nil {
+			return err
+		}
+		_, err = writeDB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s_uploads WHERE started < ?;", s.table), cutoff)
+		return err
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to remove abandoned uploads: %w", err)
+	}
+	return removed, nil
+}
+
+// BlobReader reads a blob one chunk at a time. It implements io.ReadSeeker, so it can be passed to http.ServeContent.
+type BlobReader struct {
+	ctx       context.Context
+	store     *BlobStore
+	info      BlobInfo
+	chunkSize int
+	offset    int64
+	chunkSeq  int64
+	chunk     []byte
+}
+
+// Open returns a reader for a blob, or ErrBlobNotFound. Chunks are read on demand using ctx.
+func (s *BlobStore) Open(ctx context.Context, digest string) (*BlobReader, error) {
+	info, chunkSize, err := s.stat(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobReader{ctx: ctx, store: s, info: info, chunkSize: chunkSize, chunkSeq: -1}, nil
+}
+
+// Info returns the details of the blob being read.
+func (br *BlobReader) Info() BlobInfo {
+	return br.info
+}
+
+func (br *BlobReader) Read(p []byte) (int, error) {
+	if br.offset >= br.info.Size {
+		return 0, io.EOF
+	}
+	seq := br.offset / int64(br.chunkSize)
+	if seq != br.chunkSeq {
+		var chunk []byte
+		err := br.store.db.QueryRowContext(br.ctx, fmt.Sprintf("SELECT data FROM %s_chunks WHERE blob = ? AND seq = ?;", br.store.table), br.info.Digest, seq).Scan(&chunk)
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("chunk %d of blob %s is missing: %w", seq, br.info.Digest, ErrBlobNotFound)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error reading chunk %d of blob %s: %w", seq, br.info.Digest, err)
+		}
+		br.chunk, br.chunkSeq = chunk, seq
+	}
+	n := copy(p, br.chunk[br.offset-seq*int64(br.chunkSize):])
+	br.offset += int64(n)
+	return n, nil
+}
+
+func (br *BlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += br.offset
+	case io.SeekEnd:
+		offset += br.info.Size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	br.offset = offset
+	return offset, nil
+}
+
+var blobDigestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// BlobHandler serves blobs over HTTP at /{digest}, with the digest as a strong ETag. Range requests and conditional requests are handled by http.ServeContent, and because a digest always refers to the same content, responses can be cached forever. Mount it with http.StripPrefix if it doesn't live at the root.
+type BlobHandler struct {
+	store       *BlobStore
+	contentType func(r *http.Request, info BlobInfo) string
+}
+
+// NewBlobHandler creates a BlobHandler. contentType chooses the Content-Type for each response and may be nil, in which case it is sniffed from the start of the blob.
+func NewBlobHandler(store *BlobStore, contentType func(r *http.Request, info BlobInfo) string) *BlobHandler {
+	return &BlobHandler{store: store, contentType: contentType}
+}
+
+func (h *BlobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	digest := strings.TrimPrefix(r.URL.Path, "/")
+	if !blobDigestPattern.MatchString(digest) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	reader, err := h.store.Open(r.Context(), digest)
+	if errors.Is(err, ErrBlobNotFound) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to open blob", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", "\""+digest+"\"")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if h.contentType != nil {
+		if contentType := h.contentType(r, reader.Info()); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+	}
+	http.ServeContent(w, r, "", reader.Info().Created, reader)
+}
@@ -0,0 +1,202 @@
+package greener_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+// hookReader waits for delay before each read, and calls hook once, just before reading when only remaining bytes are left.
+type hookReader struct {
+	r         *bytes.Reader
+	delay     time.Duration
+	remaining int
+	hook      func()
+}
+
+func (h *hookReader) Read(p []byte) (int, error) {
+	time.Sleep(h.delay)
+	if h.hook != nil && h.r.Len() <= h.remaining {
+		h.hook()
+		h.hook = nil
+	}
+	return h.r.Read(p)
+}
+
+func TestBlobStore(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	db := newTestBatchDB(t, "blob")
+	store, err := greener.NewBlobStoreTable(ctx, db, "blob", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countChunks := func() int {
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM blob_chunks").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	content := []byte(strings.Repeat("0123456789", 4) + "abc")
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	t.Run("Put, Open and Seek", func(t *testing.T) {
+		info, err := store.Put(ctx, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Digest != digest || info.Size != int64(len(content)) || info.Refs != 1 {
+			t.Fatalf("Unexpected info %+v", info)
+		}
+		if n := countChunks(); n != 5 {
+			t.Fatalf("Expected 5 chunks, got %d", n)
+		}
+		reader, err := store.Open(ctx, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("Unexpected content %q %v", got, err)
+		}
+		if _, err := reader.Seek(-5, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		got, err = io.ReadAll(reader)
+		if err != nil || string(got) != "89abc" {
+			t.Fatalf("Unexpected content after seeking %q %v", got, err)
+		}
+		if _, err := store.Open(ctx, strings.Repeat("0", 64)); !errors.Is(err, greener.ErrBlobNotFound) {
+			t.Fatalf("Expected ErrBlobNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Deduplication, references and GC", func(t *testing.T) {
+		info, err := store.Put(ctx, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Refs != 2 || countChunks() != 5 {
+			t.Fatalf("Expected the content to be stored once with two references, got %+v and %d chunks", info, countChunks())
+		}
+		if _, err := store.Put(ctx, &failingReader{r: bytes.NewReader(content)}); err == nil {
+			t.Fatalf("Expected a failed upload to return an error")
+		}
+		if err := store.Release(ctx, digest); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Release(ctx, digest); err != nil {
+			t.Fatal(err)
+		}
+		if removed, err := store.GC(ctx, time.Hour); err != nil || removed != 0 || countChunks() <= 5 {
+			t.Fatalf("Expected the grace period to keep everything, got %d removed, %v", removed, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		removed, err := store.GC(ctx, time.Millisecond)
+		if err != nil || removed != 1 {
+			t.Fatalf("Expected one blob to be removed, got %d %v", removed, err)
+		}
+		if n := countChunks(); n != 0 {
+			t.Fatalf("Expected blob and abandoned upload chunks to be removed, got %d", n)
+		}
+		if _, err := store.Stat(ctx, digest); !errors.Is(err, greener.ErrBlobNotFound) {
+			t.Fatalf("Expected ErrBlobNotFound after GC, got %v", err)
+		}
+		if err := store.AddRef(ctx, digest); !errors.Is(err, greener.ErrBlobNotFound) {
+			t.Fatalf("Expected ErrBlobNotFound, got %v", err)
+		}
+	})
+
+	t.Run("GC during an upload", func(t *testing.T) {
+		// Mid-way through, a chunk can't be added to the removed upload, and at the end, the blob can't be stored with chunks missing
+		for _, remaining := range []int{len(content) - 10, 0} {
+			reader := &hookReader{r: bytes.NewReader(content), remaining: remaining, hook: func() {
+				time.Sleep(5 * time.Millisecond)
+				if _, err := store.GC(ctx, 0); err != nil {
+					t.Error(err)
+				}
+			}}
+			if _, err := store.Put(ctx, reader); !errors.Is(err, greener.ErrBlobUploadAbandoned) {
+				t.Fatalf("Expected ErrBlobUploadAbandoned with %d bytes left, got %v", remaining, err)
+			}
+			if _, err := store.Stat(ctx, digest); !errors.Is(err, greener.ErrBlobNotFound) {
+				t.Fatalf("Expected no blob to be stored, got %v", err)
+			}
+			if n := countChunks(); n != 0 {
+				t.Fatalf("Expected no chunks to be left behind, got %d", n)
+			}
+		}
+		// Writing chunks keeps an upload that is slow but not idle, even once it started longer than the grace period ago
+		reader := &hookReader{r: bytes.NewReader(content), delay: 50 * time.Millisecond, remaining: 0, hook: func() {
+			if _, err := store.GC(ctx, 150*time.Millisecond); err != nil {
+				t.Error(err)
+			}
+		}}
+		if _, err := store.Put(ctx, reader); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Release(ctx, digest); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("HTTP handler", func(t *testing.T) {
+		if _, err := store.Put(ctx, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		handler := greener.NewBlobHandler(store, func(r *http.Request, info greener.BlobInfo) string { return "text/plain" })
+		request := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec
+		}
+		rec := request("/"+digest, nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != string(content) || rec.Header().Get("ETag") != "\""+digest+"\"" || rec.Header().Get("Content-Type") != "text/plain" {
+			t.Fatalf("Unexpected response %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+		}
+		rec = request("/"+digest, map[string]string{"Range": "bytes=8-12"})
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != "89012" {
+			t.Fatalf("Unexpected range response %d %q", rec.Code, rec.Body.String())
+		}
+		rec = request("/"+digest, map[string]string{"If-None-Match": "\"" + digest + "\""})
+		if rec.Code != http.StatusNotModified {
+			t.Fatalf("Expected 304, got %d", rec.Code)
+		}
+		if rec := request("/not-a-digest", nil); rec.Code != http.StatusNotFound {
+			t.Fatalf("Expected 404, got %d", rec.Code)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+// go run cmd/kvtool/main.go export -db app.db > backup.jsonl
+// go run cmd/kvtool/main.go import -db other.db -dry-run < backup.jsonl
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/thejimmyg/greener"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage:
+  kvtool export -db <path> [-table kv] [-prefix <pk prefix>] [-include-expired] [-out <file>]
+  kvtool import -db <path> [-table kv] [-mode upsert|create] [-dry-run] [-in <file>]
+
+Rows are read and written as JSON Lines with pk, sk, data and expires fields.
+Without -out or -in, stdout and stdin are used. With -dry-run, import prints
+the changes it would make without writing anything. Export and -dry-run fail
+if the database or table doesn't exist, rather than creating them.`)
+}
+
+// openKV opens the KV table in the database at dbPath. If mustExist is true, it fails rather than creating the database file or table, so that reading from a mistyped path is an error instead of silently finding nothing.
+func openKV(ctx context.Context, dbPath, table string, mustExist bool) (*greener.KV, *greener.BatchDB, error) {
+	if mustExist {
+		if _, err := os.Stat(dbPath); err != nil {
+			return nil, nil, fmt.Errorf("error opening database: %w", err)
+		}
+	}
+	db, err := greener.NewBatchDB(dbPath, 3)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening database: %w", err)
+	}
+	if mustExist {
+		var count int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("error looking for table %s: %w", table, err)
+		}
+		if count == 0 {
+			db.Close()
+			return nil, nil, fmt.Errorf("database %s has no table %s", dbPath, table)
+		}
+	}
+	kv, err := greener.NewKVTable(ctx, db, table)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return kv, db, nil
+}
+
+func export(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := flags.String("db", "", "path to the SQLite database")
+	table := flags.String("table", "kv", "name of the KV table")
+	prefix := flags.String("prefix", "", "only export partitions whose pk starts with this prefix")
+	includeExpired := flags.Bool("include-expired", false, "also export rows that have expired")
+	out := flags.String("out", "", "file to write to instead of stdout")
+	flags.Parse(args)
+	if *dbPath == "" {
+		return fmt.Errorf("-db is required")
+	}
+
+	kv, db, err := openKV(ctx, *dbPath, *table, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	count, err := kv.Export(ctx, w, greener.KVExportFilter{PKPrefix: *prefix, IncludeExpired: *includeExpired})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d rows\n", count)
+	return nil
+}
+
+func importRows(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dbPath := flags.String("db", "", "path to the SQLite database")
+	table := flags.String("table", "kv", "name of the KV table")
+	modeName := flags.String("mode", "upsert", "upsert to overwrite existing rows, create to skip them")
+	dryRun := flags.Bool("dry-run", false, "print the changes that would be made without writing them")
+	in := flags.String("in", "", "file to read from instead of stdin")
+	flags.Parse(args)
+	if *dbPath == "" {
+		return fmt.Errorf("-db is required")
+	}
+	var mode greener.KVImportMode
+	switch *modeName {
+	case "upsert":
+		mode = greener.KVImportUpsert
+	case "create":
+		mode = greener.KVImportCreate
+	default:
+		return fmt.Errorf("unknown mode %q", *modeName)
+	}
+
+	// A dry run only reads, so it mustn't create the database or table either
+	kv, db, err := openKV(ctx, *dbPath, *table, *dryRun)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	if !*dryRun {
+		stats, err := kv.Import(ctx, r, mode)
+		fmt.Fprintf(os.Stderr, "Wrote %d rows, skipped %d existing rows\n", stats.Written, stats.Skipped)
+		return err
+	}
+
+	counts := map[greener.KVImportAction]int{}
+	err = kv.DiffImport(ctx, r, mode, func(change greener.KVImportChange) error {
+		counts[change.Action]++
+		newData, err := json.Marshal(change.Record.Data)
+		if err != nil {
+			return err
+		}
+		switch change.Action {
+		case greener.KVImportActionCreate:
+			fmt.Printf("+ %s %s %s\n", change.Record.PK, change.Record.SK, newData)
+		case greener.KVImportActionUpdate:
+			oldData, err := json.Marshal(change.Current.Data)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("~ %s %s %s -> %s\n", change.Record.PK, change.Record.SK, oldData, newData)
+		}
+		return nil
+	})
+	fmt.Fprintf(os.Stderr, "Dry run: %d to create, %d to update, %d unchanged, %d to skip\n",
+		counts[greener.KVImportActionCreate], counts[greener.KVImportActionUpdate], counts[greener.KVImportActionUnchanged], counts[greener.KVImportActionSkip])
+	return err
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	ctx := context.Background()
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = export(ctx, os.Args[2:])
+	case "import":
+		err = importRows(ctx, os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -13,6 +13,27 @@ import (
 	"github.com/thejimmyg/greener"
 )
 
+// newTestBatchDB creates a BatchDB in a temporary directory that is removed when the test finishes.
+func newTestBatchDB(t *testing.T, name string) *greener.BatchDB {
+	tempDir, err := ioutil.TempDir("", "db_"+name+"_temp")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(tempDir) // Clean up the directory when you're done.
+	})
+	db, err := greener.NewBatchDB(filepath.Join(tempDir, name+".db"), 3)
+	if err != nil {
+		t.Fatalf("Error creating the database connections: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+	})
+	return db
+}
+
 func TestBatchDB(t *testing.T) {
 	t.Parallel()
 
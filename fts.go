@@ -4,17 +4,107 @@ package greener
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
+// FTS is a full text search index with facets and metadata, stored in the documents, facets, document_facets and document_metadata tables.
 type FTS struct {
-	db DB
+	db        DB
+	fields    []FTSField
+	tokenizer FTSTokenizer
+	substring bool
+}
+
+// FTSField is a named, searchable field of a document. Matches in fields with a higher Weight rank higher, using the BM25 weights built into FTS5.
+type FTSField struct {
+	Name   string
+	Weight float64
+}
+
+// FTSOptions configures the index created by NewFTSWithOptions.
+type FTSOptions struct {
+	// Fields are the searchable fields of each document, such as title, body and tags. Put stores its content in the first field. Defaults to a single field called content.
+	Fields []FTSField
+	// Tokenizer decides how text is split into the terms that searches match. Defaults to FTSTokenizerUnicode61.
+	Tokenizer FTSTokenizer
+	// RemoveDiacritics makes letters match whatever accents they have, so cafe matches café. FTS5 already does this for letters with a single accent unless Tokenizer is FTSTokenizerTrigram, and this extends it to every letter.
+	RemoveDiacritics bool
+	// Substring keeps a second copy of the index in a documents_trigram table, using the trigram tokenizer, so that SearchOptions.Substring can find text in the middle of words. It roughly doubles the size of the index and the cost of writes. Turning it off drops the table.
+	Substring bool
+}
+
+// FTSTokenizer is an FTS5 tokenizer.
+type FTSTokenizer string
+
+const (
+	// FTSTokenizerUnicode61 splits text into words, ignoring case and punctuation.
+	FTSTokenizerUnicode61 FTSTokenizer = "unicode61"
+	// FTSTokenizerPorter splits text into words like FTSTokenizerUnicode61 and then reduces English words to their stems, so running matches run and runs.
+	FTSTokenizerPorter FTSTokenizer = "porter"
+	// FTSTokenizerTrigram indexes every three character sequence, so that any part of a word can be found, at the cost of a much larger index. Queries must be at least three characters long.
+	FTSTokenizerTrigram FTSTokenizer = "trigram"
+)
+
+// tokenize returns the FTS5 tokenize option for the tokenizer options.
+func (o FTSOptions) tokenize() string {
+	switch o.Tokenizer {
+	case FTSTokenizerPorter:
+		if o.RemoveDiacritics {
+			return "porter unicode61 remove_diacritics 2"
+		}
+		return "porter unicode61"
+	case FTSTokenizerTrigram:
+		if o.RemoveDiacritics {
+			return "trigram remove_diacritics 1"
+		}
+		return "trigram"
+	default:
+		if o.RemoveDiacritics {
+			return "unicode61 remove_diacritics 2"
+		}
+		return "unicode61"
+	}
+}
+
+var ftsFieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,62}$`)
+
+func (o FTSOptions) withDefaults() (FTSOptions, error) {
+	if len(o.Fields) == 0 {
+		o.Fields = []FTSField{{Name: "content", Weight: 1}}
+	}
+	if o.Tokenizer == "" {
+		o.Tokenizer = FTSTokenizerUnicode61
+	}
+	if o.Tokenizer != FTSTokenizerUnicode61 && o.Tokenizer != FTSTokenizerPorter && o.Tokenizer != FTSTokenizerTrigram {
+		return o, fmt.Errorf("unknown tokenizer %q", o.Tokenizer)
+	}
+	seen := map[string]bool{}
+	for i, field := range o.Fields {
+		if !ftsFieldNamePattern.MatchString(field.Name) || field.Name == "docid" || field.Name == "rank" {
+			return o, fmt.Errorf("invalid field name %q: names must be lower case letters, digits and underscores, and not docid or rank", field.Name)
+		}
+		if seen[field.Name] {
+			return o, fmt.Errorf("duplicate field name %q", field.Name)
+		}
+		seen[field.Name] = true
+		if field.Weight <= 0 {
+			o.Fields[i].Weight = 1
+		}
+	}
+	return o, nil
 }
 
 type Facet struct {
@@ -32,16 +122,36 @@ type FacetCount struct {
 	Values []FacetValueCount
 }
 
+// NewFTS creates an index with a single content field.
 func NewFTS(ctx context.Context, db DB) (*FTS, error) {
+	return NewFTSWithOptions(ctx, db, FTSOptions{})
+}
+
+// NewFTSWithOptions creates an index whose documents have the given fields and tokenizer. If the documents table already exists with different fields, an error is returned rather than silently using the old schema. If it exists with a different tokenizer, it is rebuilt with the new one, which rewrites the whole index in a single write.
+func NewFTSWithOptions(ctx context.Context, db DB, opts FTSOptions) (*FTS, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
 	// Ensure the FTS table and facet tables exist
 	// _, err = d.ExecContext(ctx, "INSERT INTO document_facets (document_id, facet_id) VALUES (?, ?)", docid, facetID)
 	// search_test.go:64: Error adding facets: Could not insert document_facet: SQL logic error: foreign key mismatch - "document_facets" referencing "documents" (1)
 
+	var columns []string
+	for _, field := range opts.Fields {
+		columns = append(columns, field.Name)
+	}
 	queries := []string{
-		`CREATE VIRTUAL TABLE IF NOT EXISTS documents USING fts5(content, docid UNINDEXED);`,
+		// The tokenizer each index was built with, which isn't otherwise easy to read back from SQLite
+		`CREATE TABLE IF NOT EXISTS fts_config (key TEXT PRIMARY KEY, value TEXT NOT NULL);`,
 		`CREATE TABLE IF NOT EXISTS facets (id INTEGER PRIMARY KEY, name TEXT, value TEXT, UNIQUE(name, value));`,
 		// `CREATE TABLE IF NOT EXISTS document_facets (document_id TEXT, facet_id INTEGER, FOREIGN KEY(document_id) REFERENCES documents(docid), FOREIGN KEY(facet_id) REFERENCES facets(id));`,
 		`CREATE TABLE IF NOT EXISTS document_facets (document_id TEXT, facet_id INTEGER, FOREIGN KEY(facet_id) REFERENCES facets(id));`,
+		`CREATE TABLE IF NOT EXISTS document_metadata (document_id TEXT PRIMARY KEY, data JSON NOT NULL);`,
+		// Older versions could associate a facet with a document more than once, so remove duplicates before adding the unique index
+		`DELETE FROM document_facets WHERE NOT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'index' AND name = 'document_facets_unique') AND rowid NOT IN (SELECT MIN(rowid) FROM document_facets GROUP BY document_id, facet_id);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS document_facets_unique ON document_facets (document_id, facet_id);`,
+		`CREATE INDEX IF NOT EXISTS document_facets_facet ON document_facets (facet_id);`,
 	}
 	for _, query := range queries {
 		err := db.Write(func(d WriteDBHandler) error {
@@ -54,47 +164,234 @@ func NewFTS(ctx context.Context, db DB) (*FTS, error) {
 			return nil, err
 		}
 	}
-	return &FTS{db: db}, nil
-}
-
-func (se *FTS) Put(ctx context.Context, docid string, reader io.Reader) error {
-	content, err := ioutil.ReadAll(reader)
-	if err != nil {
+	if err := migrateFTSTable(ctx, db, "documents", columns, opts.tokenize()); err != nil {
+		return nil, err
+	}
+	// The vocabulary of the index used by Suggest, which refers to the documents table by name so survives it being rebuilt
+	err = db.Write(func(d WriteDBHandler) error {
+		_, err := d.ExecContext(ctx, "CREATE VIRTUAL TABLE IF NOT EXISTS documents_vocab USING fts5vocab(documents, 'row');")
 		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create the vocabulary table: %w", err)
 	}
-
-	err = se.db.Write(func(d WriteDBHandler) error {
-		// I think we need to do the two operations separately because of a limitation in FT5 virtual tables, but should check this again.
-
-		// Attempt to update the document first.
-		result, err := d.ExecContext(ctx, "UPDATE documents SET content = ? WHERE docid = ?", string(content), docid)
-		if err != nil {
+	if opts.Substring {
+		if err := migrateFTSTable(ctx, db, "documents_trigram", columns, "trigram"); err != nil {
+			return nil, err
+		}
+	} else {
+		err := db.Write(func(d WriteDBHandler) error {
+			if _, err := d.ExecContext(ctx, "DROP TABLE IF EXISTS documents_trigram"); err != nil {
+				return err
+			}
+			_, err := d.ExecContext(ctx, "DELETE FROM fts_config WHERE key = 'documents_trigram'")
 			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not drop the substring index: %w", err)
 		}
-		// Check if the update operation affected any rows.
-		rowsAffected, err := result.RowsAffected()
+	}
+	return &FTS{db: db, fields: opts.Fields, tokenizer: opts.Tokenizer, substring: opts.Substring}, nil
+}
+
+// migrateFTSTable creates the FTS5 table called table with the given columns and tokenizer. If the table exists with a different tokenizer, its rows are copied into a new table built with the new tokenizer, which then replaces it. The documents_trigram table is filled from documents when it is first created. Tables created before fts_config existed used FTS5's default tokenizer, unicode61.
+func migrateFTSTable(ctx context.Context, db DB, table string, columns []string, tokenize string) error {
+	all := strings.Join(append(append([]string{}, columns...), "docid"), ", ")
+	create := func(d WriteDBHandler, name string) error {
+		_, err := d.ExecContext(ctx, fmt.Sprintf("CREATE VIRTUAL TABLE %s USING fts5(%s, docid UNINDEXED, tokenize = '%s');", name, strings.Join(columns, ", "), tokenize))
+		return err
+	}
+	err := db.Write(func(d WriteDBHandler) error {
+		exists, err := ftsTableExists(ctx, d, table)
 		if err != nil {
 			return err
 		}
-
-		// If no rows were affected by the update, the document does not exist and needs to be inserted.
-		if rowsAffected == 0 {
-			_, err = d.ExecContext(ctx, "INSERT INTO documents(docid, content) VALUES(?, ?)", docid, string(content))
+		if !exists {
+			if err := create(d, table); err != nil {
+				return err
+			}
+			if table != "documents" {
+				if _, err := d.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM documents", table, all, all)); err != nil {
+					return fmt.Errorf("could not fill %s: %w", table, err)
+				}
+			}
+		} else {
+			existing, err := ftsColumns(ctx, d, table)
+			if err != nil {
+				return err
+			}
+			if want := append(append([]string{}, columns...), "docid"); strings.Join(existing, ",") != strings.Join(want, ",") {
+				return fmt.Errorf("the %s table has columns %v but fields %v were requested", table, existing, columns)
+			}
+			current := "unicode61"
+			rows, err := d.QueryContext(ctx, "SELECT value FROM fts_config WHERE key = ?", table)
 			if err != nil {
 				return err
 			}
+			defer rows.Close()
+			if rows.Next() {
+				if err := rows.Scan(&current); err != nil {
+					return err
+				}
+			}
+			if err := rows.Close(); err != nil {
+				return err
+			}
+			if current != tokenize {
+				if err := create(d, table+"_rebuild"); err != nil {
+					return err
+				}
+				if _, err := d.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s_rebuild (%s) SELECT %s FROM %s", table, all, all, table)); err != nil {
+					return fmt.Errorf("could not rebuild %s: %w", table, err)
+				}
+				if _, err := d.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", table)); err != nil {
+					return err
+				}
+				if _, err := d.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s_rebuild RENAME TO %s", table, table)); err != nil {
+					return err
+				}
+			}
 		}
-		return nil
+		_, err = d.ExecContext(ctx, "INSERT INTO fts_config (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", table, tokenize)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not create the %s index: %w", table, err)
+	}
+	return nil
+}
+
+func ftsTableExists(ctx context.Context, d WriteDBHandler, table string) (bool, error) {
+	rows, err := d.QueryContext(ctx, "SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	exists := rows.Next()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	return exists, rows.Close()
+}
+
+// ftsColumns returns the column names of an existing FTS5 table.
+func ftsColumns(ctx context.Context, d WriteDBHandler, table string) ([]string, error) {
+	rows, err := d.QueryContext(ctx, "SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// Fields returns the index's fields.
+func (se *FTS) Fields() []FTSField {
+	return append([]FTSField(nil), se.fields...)
+}
+
+// Put stores the content read from reader in the first field of the document, leaving any other fields empty.
+func (se *FTS) Put(ctx context.Context, docid string, reader io.Reader) error {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return se.PutFields(ctx, docid, map[string]string{se.fields[0].Name: string(content)})
+}
+
+// PutFields stores a document with several fields, replacing any existing document with the same docid. Fields that aren't given are stored empty, and unknown fields are an error.
+func (se *FTS) PutFields(ctx context.Context, docid string, fields map[string]string) error {
+	values, err := se.fieldValues(fields)
+	if err != nil {
+		return err
+	}
+	return se.db.Write(func(d WriteDBHandler) error {
+		return se.putFieldsTx(ctx, d, docid, values)
 	})
+}
+
+// fieldValues orders the values of fields to match the documents table's columns.
+func (se *FTS) fieldValues(fields map[string]string) ([]interface{}, error) {
+	values := make([]interface{}, len(se.fields))
+	known := 0
+	for i, field := range se.fields {
+		value, ok := fields[field.Name]
+		if ok {
+			known++
+		}
+		values[i] = value
+	}
+	if known != len(fields) {
+		return nil, fmt.Errorf("document has fields that aren't in the index, which has %v", se.fieldNames())
+	}
+	return values, nil
+}
+
+func (se *FTS) fieldNames() []string {
+	names := make([]string, len(se.fields))
+	for i, field := range se.fields {
+		names[i] = field.Name
+	}
+	return names
+}
+
+// putFieldsTx stores a document's fields in the documents table, and in documents_trigram if the substring index is enabled.
+func (se *FTS) putFieldsTx(ctx context.Context, d WriteDBHandler, docid string, values []interface{}) error {
+	if err := putFTSRowTx(ctx, d, "documents", se.fieldNames(), docid, values); err != nil {
+		return err
+	}
+	if se.substring {
+		return putFTSRowTx(ctx, d, "documents_trigram", se.fieldNames(), docid, values)
+	}
+	return nil
+}
+
+func putFTSRowTx(ctx context.Context, d WriteDBHandler, table string, names []string, docid string, values []interface{}) error {
+	// I think we need to do the two operations separately because of a limitation in FT5 virtual tables, but should check this again.
+
+	// Attempt to update the document first.
+	result, err := d.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = ? WHERE docid = ?", table, strings.Join(names, " = ?, ")), append(values, docid)...)
 	if err != nil {
 		return err
 	}
+	// Check if the update operation affected any rows.
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// If no rows were affected by the update, the document does not exist and needs to be inserted.
+	if rowsAffected == 0 {
+		_, err = d.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s(docid, %s) VALUES(?%s)", table, strings.Join(names, ", "), strings.Repeat(", ?", len(names))), append([]interface{}{docid}, values...)...)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Delete removes a document along with its facet associations and metadata, in one write.
 func (se *FTS) Delete(ctx context.Context, docid string) error {
 	err := se.db.Write(func(d WriteDBHandler) error {
-		_, err := d.ExecContext(ctx, "DELETE FROM documents WHERE docid = ?", docid)
+		if _, err := d.ExecContext(ctx, "DELETE FROM documents WHERE docid = ?", docid); err != nil {
+			return err
+		}
+		if se.substring {
+			if _, err := d.ExecContext(ctx, "DELETE FROM documents_trigram WHERE docid = ?", docid); err != nil {
+				return err
+			}
+		}
+		if _, err := d.ExecContext(ctx, "DELETE FROM document_facets WHERE document_id = ?", docid); err != nil {
+			return err
+		}
+		_, err := d.ExecContext(ctx, "DELETE FROM document_metadata WHERE document_id = ?", docid)
 		return err
 	})
 	if err != nil {
@@ -103,70 +400,535 @@ func (se *FTS) Delete(ctx context.Context, docid string) error {
 	return nil
 }
 
+// Get returns the content of the document's first field.
 func (se *FTS) Get(ctx context.Context, docid string) (io.Reader, error) {
-	var content string
-	row := se.db.QueryRowContext(ctx, "SELECT content FROM documents WHERE docid = ?", docid)
-	if err := row.Scan(&content); err != nil {
+	fields, err := se.GetFields(ctx, docid)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(fields[se.fields[0].Name]), nil
+}
+
+// GetFields returns all the fields of a document.
+func (se *FTS) GetFields(ctx context.Context, docid string) (map[string]string, error) {
+	names := se.fieldNames()
+	values := make([]string, len(names))
+	dest := make([]interface{}, len(names))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	row := se.db.QueryRowContext(ctx, fmt.Sprintf("SELECT %s FROM documents WHERE docid = ?", strings.Join(names, ", ")), docid)
+	if err := row.Scan(dest...); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errors.New("document not found")
 		}
 		return nil, err
 	}
-	return strings.NewReader(content), nil
+	fields := make(map[string]string, len(names))
+	for i, name := range names {
+		fields[name] = values[i]
+	}
+	return fields, nil
+}
+
+// rankExpression returns the BM25 ranking function with the weight of each field. The docid column is never matched so its weight doesn't matter.
+func (se *FTS) rankExpression(table string) string {
+	weights := make([]string, len(se.fields))
+	for i, field := range se.fields {
+		weights[i] = strconv.FormatFloat(field.Weight, 'f', -1, 64)
+	}
+	return fmt.Sprintf("bm25(%s, %s, 0)", table, strings.Join(weights, ", "))
+}
+
+// SearchResult is one document matching a search.
+type SearchResult struct {
+	DocID string
+	// Snippet is the matching part of the document, escaped and with matches marked as SnippetOptions describes.
+	Snippet template.HTML
+	// Rank is the BM25 score, where lower numbers are better matches.
+	Rank     float64
+	Metadata map[string]string
+}
+
+// SearchOptions controls which page of matches SearchWithOptions returns.
+type SearchOptions struct {
+	// Limit is the maximum number of results on the page. Defaults to 20. A negative Limit returns every match.
+	Limit int
+	// Offset skips this many matches. It is simple but SQLite still has to rank the skipped matches, so prefer Cursor for deep paging.
+	Offset int
+	// Cursor is the NextCursor of the previous page, and starts this page straight after that page's last result. It can't be combined with Offset.
+	Cursor string
+	// CountTotal counts every match, which costs an extra query.
+	CountTotal bool
+	// Facets restricts the search to documents with these facets. A document must match at least one of the values given for each facet name, so {Year 2023}, {Year 2024}, {Topic Gardening} finds gardening documents from either year.
+	Facets []Facet
+	// CountFacets counts the facets of every match, not just those on this page, which costs an extra query.
+	CountFacets bool
+	// Raw passes the query to FTS5 as it is instead of parsing it with ParseQuery or ParseSubstringQuery, for callers that build FTS5 expressions themselves. Invalid syntax then fails with an SQLite error.
+	Raw bool
+	// Correct retries a search that finds nothing with the query returned by Correct, if that is different, and reports the query used in SearchPage.CorrectedQuery. It only applies to the first page of a search that isn't Raw or Substring, and not at all to an index using FTSTokenizerTrigram, whose vocabulary has no words to correct to.
+	Correct bool
+	// Snippet controls how each result's Snippet is built.
+	Snippet SnippetOptions
+	// Substring searches the trigram index enabled by FTSOptions.Substring, so each word of the query can match anywhere inside a word, and the query is parsed with ParseSubstringQuery.
+	Substring bool
 }
 
-func (se *FTS) Search(ctx context.Context, query string) ([]map[string]string, error) {
-	rows, err := se.db.QueryContext(ctx, "SELECT docid, snippet(documents, 0, '<b>', '</b>', '...', 64) FROM documents WHERE documents MATCH ? ORDER BY rank", query)
+// SnippetOptions controls the snippet of matching text returned with each search result. The document text is HTML escaped, so only Open and Close are treated as markup.
+type SnippetOptions struct {
+	// Open and Close surround each match. Default to <b> and </b>.
+	Open  template.HTML
+	Close template.HTML
+	// Ellipsis marks text left out at the start or end of the snippet. Defaults to "...".
+	Ellipsis string
+	// Tokens is the maximum number of words in the snippet, up to 64. Defaults to 64.
+	Tokens int
+	// Field is the field the snippet is taken from. Defaults to whichever field matched best, or the first field when Highlight is set.
+	Field string
+	// Highlight returns the whole field with every match marked instead of a short snippet around the best matches.
+	Highlight bool
+}
+
+func (o SnippetOptions) withDefaults() (SnippetOptions, error) {
+	if o.Open == "" && o.Close == "" {
+		o.Open, o.Close = "<b>", "</b>"
+	}
+	if o.Ellipsis == "" {
+		o.Ellipsis = "..."
+	}
+	if o.Tokens == 0 {
+		o.Tokens = 64
+	}
+	if o.Tokens < 1 || o.Tokens > 64 {
+		return o, fmt.Errorf("snippet tokens must be between 1 and 64")
+	}
+	return o, nil
+}
+
+// snippetMarkers is the start of the markers FTS5 puts around matches and in place of cut text when making a snippet, followed by one of the ftsSnippet kinds. Each search uses a new random one, so that text in a document can't be taken for a marker, and renderSnippet can escape everything else before replacing the markers with the markup in SnippetOptions.
+type snippetMarkers string
+
+const (
+	ftsSnippetOpen     = "o"
+	ftsSnippetClose    = "c"
+	ftsSnippetEllipsis = "e"
+)
+
+func newSnippetMarkers() (snippetMarkers, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate snippet markers: %w", err)
+	}
+	return snippetMarkers("\ue000" + hex.EncodeToString(nonce)), nil
+}
+
+// snippetExpression returns the SQL that makes the snippet for each result, using markers.
+func (se *FTS) snippetExpression(table string, opts SnippetOptions, markers snippetMarkers) (string, error) {
+	column := -1
+	if opts.Field != "" || opts.Highlight {
+		column = 0
+		if opts.Field != "" {
+			column = -1
+			for i, field := range se.fields {
+				if field.Name == opts.Field {
+					column = i
+				}
+			}
+			if column < 0 {
+				return "", fmt.Errorf("can't make a snippet from unknown field %q", opts.Field)
+			}
+		}
+	}
+	if opts.Highlight {
+		return fmt.Sprintf("highlight(%s, %d, '%s', '%s')", table, column, markers+ftsSnippetOpen, markers+ftsSnippetClose), nil
+	}
+	return fmt.Sprintf("snippet(%s, %d, '%s', '%s', '%s', %d)", table, column, markers+ftsSnippetOpen, markers+ftsSnippetClose, markers+ftsSnippetEllipsis, opts.Tokens), nil
+}
+
+// renderSnippet escapes the text of a snippet made by snippetExpression and replaces its markers.
+func renderSnippet(snippet string, opts SnippetOptions, markers snippetMarkers) template.HTML {
+	var b strings.Builder
+	for {
+		i := strings.Index(snippet, string(markers))
+		if i < 0 || i+len(markers) >= len(snippet) {
+			break
+		}
+		b.WriteString(template.HTMLEscapeString(snippet[:i]))
+		switch snippet[i+len(markers) : i+len(markers)+1] {
+		case ftsSnippetOpen:
+			b.WriteString(string(opts.Open))
+		case ftsSnippetClose:
+			b.WriteString(string(opts.Close))
+		default:
+			b.WriteString(template.HTMLEscapeString(opts.Ellipsis))
+		}
+		snippet = snippet[i+len(markers)+1:]
+	}
+	b.WriteString(template.HTMLEscapeString(snippet))
+	return template.HTML(b.String())
+}
+
+func (o SearchOptions) withDefaults() (SearchOptions, error) {
+	if o.Limit == 0 {
+		o.Limit = 20
+	}
+	var err error
+	if o.Snippet, err = o.Snippet.withDefaults(); err != nil {
+		return o, err
+	}
+	if o.Offset < 0 {
+		return o, fmt.Errorf("offset must not be negative")
+	}
+	if o.Offset > 0 && o.Cursor != "" {
+		return o, fmt.Errorf("offset and cursor can't be used together")
+	}
+	return o, nil
+}
+
+// SearchPage is one page of search results.
+type SearchPage struct {
+	Results []SearchResult
+	// Total is the number of matches on all pages, or -1 if CountTotal wasn't set.
+	Total int
+	// FacetCounts counts the facets of the matches on all pages when CountFacets is set. Facets are ordered by name and values by count, highest first.
+	FacetCounts []FacetCount
+	// HasMore is true when there are matches after this page, in which case NextCursor and NextOffset fetch the next one.
+	HasMore    bool
+	NextCursor string
+	NextOffset int
+	// CorrectedQuery is the spelling corrected query that was searched instead when SearchOptions.Correct is set and the original query found nothing. Pass it as the query when fetching the next page.
+	CorrectedQuery string
+}
+
+// searchCursor is the position of the last result on a page, encoded into SearchPage.NextCursor.
+type searchCursor struct {
+	Rank  float64 `json:"r"`
+	DocID string  `json:"d"`
+}
+
+func encodeSearchCursor(result SearchResult) string {
+	data, _ := json.Marshal(searchCursor{Rank: result.Rank, DocID: result.DocID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSearchCursor(cursor string) (searchCursor, error) {
+	var c searchCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("invalid search cursor: %w", err)
+	}
+	return c, nil
+}
+
+// Search returns every document matching query, best first. The query is parsed with ParseQuery, so it is safe to pass what a user typed, and a term can be restricted to one field with a prefix such as title:report. The snippet comes from whichever field matched best. Use SearchWithOptions to fetch one page at a time or to pass raw FTS5 syntax.
+func (se *FTS) Search(ctx context.Context, query string) ([]SearchResult, error) {
+	page, err := se.SearchWithOptions(ctx, query, SearchOptions{Limit: -1})
 	if err != nil {
 		return nil, err
 	}
+	return page.Results, nil
+}
+
+// SearchWithOptions returns one page of the documents matching query, best first, with ties broken by docid so that pages never overlap.
+func (se *FTS) SearchWithOptions(ctx context.Context, query string, opts SearchOptions) (SearchPage, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return SearchPage{}, err
+	}
+	input := query
+	table := "documents"
+	if opts.Substring {
+		if !se.substring {
+			return SearchPage{}, fmt.Errorf("substring search needs the index to be created with FTSOptions.Substring")
+		}
+		table = "documents_trigram"
+	}
+	if !opts.Raw {
+		if opts.Substring {
+			query, err = ParseSubstringQuery(query)
+		} else {
+			query, err = se.ParseQuery(query)
+		}
+		if err != nil {
+			return SearchPage{}, err
+		}
+	}
+	rank := se.rankExpression(table)
+	markers, err := newSnippetMarkers()
+	if err != nil {
+		return SearchPage{}, err
+	}
+	snippet, err := se.snippetExpression(table, opts.Snippet, markers)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	filter, filterArgs := facetFilter(table, query, opts.Facets)
+	where, args := filter, append([]interface{}{}, filterArgs...)
+	if opts.Cursor != "" {
+		cursor, err := decodeSearchCursor(opts.Cursor)
+		if err != nil {
+			return SearchPage{}, err
+		}
+		where += fmt.Sprintf(" AND (%s > ? OR (%s = ? AND docid > ?))", rank, rank)
+		args = append(args, cursor.Rank, cursor.Rank, cursor.DocID)
+	}
+	// Fetch one extra row to find out whether there is another page
+	limit := opts.Limit
+	if limit > 0 {
+		limit++
+	}
+	args = append(args, limit, opts.Offset)
+	rows, err := se.db.QueryContext(ctx, fmt.Sprintf(`
+	    SELECT docid, %s, %s, document_metadata.data
+	    FROM %s LEFT JOIN document_metadata ON document_metadata.document_id = %s.docid
+	    WHERE %s ORDER BY 3, 1 LIMIT ? OFFSET ?`, snippet, rank, table, table, where), args...)
+	if err != nil {
+		return SearchPage{}, err
+	}
 	defer rows.Close()
 
-	var results []map[string]string
+	page := SearchPage{Results: []SearchResult{}, Total: -1}
 	for rows.Next() {
-		var docid, snippet string
-		if err := rows.Scan(&docid, &snippet); err != nil {
-			return nil, err
+		var result SearchResult
+		var metadata sql.NullString
+		var snippet string
+		if err := rows.Scan(&result.DocID, &snippet, &result.Rank, &metadata); err != nil {
+			return SearchPage{}, err
 		}
-		results = append(results, map[string]string{"docid": docid, "content": snippet})
+		result.Snippet = renderSnippet(snippet, opts.Snippet, markers)
+		if result.Metadata, err = decodeMetadata(metadata); err != nil {
+			return SearchPage{}, err
+		}
+		page.Results = append(page.Results, result)
 	}
-
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return SearchPage{}, err
+	}
+	if opts.Limit > 0 && len(page.Results) > opts.Limit {
+		page.Results = page.Results[:opts.Limit]
+		page.HasMore = true
+		page.NextCursor = encodeSearchCursor(page.Results[opts.Limit-1])
+		page.NextOffset = opts.Offset + opts.Limit
 	}
 
-	return results, nil
+	if opts.CountTotal {
+		row := se.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE "+filter, filterArgs...)
+		if err := row.Scan(&page.Total); err != nil {
+			return SearchPage{}, fmt.Errorf("could not count matches: %w", err)
+		}
+	}
+	if opts.CountFacets {
+		rows, err := se.db.QueryContext(ctx, `
+		    WITH matches AS (SELECT docid FROM `+table+` WHERE `+filter+`)
+		    SELECT f.name, f.value, COUNT(*) AS count FROM matches
+		    JOIN document_facets df ON df.document_id = matches.docid JOIN facets f ON f.id = df.facet_id
+		    GROUP BY f.name, f.value ORDER BY f.name, count DESC, f.value`, filterArgs...)
+		if err != nil {
+			return SearchPage{}, fmt.Errorf("could not count facets: %w", err)
+		}
+		defer rows.Close()
+		if page.FacetCounts, err = scanFacetCounts(rows); err != nil {
+			return SearchPage{}, fmt.Errorf("could not count facets: %w", err)
+		}
+	}
+	if opts.Correct && len(page.Results) == 0 && !opts.Raw && !opts.Substring && opts.Offset == 0 && opts.Cursor == "" && se.tokenizer != FTSTokenizerTrigram {
+		corrected, err := se.Correct(ctx, input)
+		if err != nil {
+			return SearchPage{}, err
+		}
+		if corrected != input {
+			opts.Correct = false
+			if page, err = se.SearchWithOptions(ctx, corrected, opts); err != nil {
+				return SearchPage{}, err
+			}
+			page.CorrectedQuery = corrected
+		}
+	}
+	return page, nil
 }
 
-func (se *FTS) AddFacets(ctx context.Context, docid string, facets []Facet) error {
+// facetFilter returns the WHERE clause and arguments matching query against table and restricting it to the given facets, with values for the same name ORed together and different names ANDed.
+func facetFilter(table string, query string, facets []Facet) (string, []interface{}) {
+	where := table + " MATCH ?"
+	args := []interface{}{query}
+	var names []string
+	values := map[string][]interface{}{}
 	for _, facet := range facets {
-		err := se.db.Write(func(d WriteDBHandler) error {
-			result, err := d.ExecContext(ctx, "INSERT INTO facets (name, value) VALUES (?, ?) ON CONFLICT(name, value) DO NOTHING", facet.Name, facet.Value)
-			if err != nil {
-				return fmt.Errorf("could not insert facet: %v\n", err)
-			}
+		if _, ok := values[facet.Name]; !ok {
+			names = append(names, facet.Name)
+		}
+		values[facet.Name] = append(values[facet.Name], facet.Value)
+	}
+	for _, name := range names {
+		inParams := strings.Repeat("?,", len(values[name])-1) + "?"
+		where += fmt.Sprintf(" AND docid IN (SELECT df.document_id FROM document_facets df JOIN facets f ON f.id = df.facet_id WHERE f.name = ? AND f.value IN (%s))", inParams)
+		args = append(args, name)
+		args = append(args, values[name]...)
+	}
+	return where, args
+}
 
-			facetID, err := result.LastInsertId()
-			if err != nil || facetID == 0 {
-				err = d.QueryRowContext(ctx, "SELECT id FROM facets WHERE name = ? AND value = ?", facet.Name, facet.Value).Scan(&facetID)
-				if err != nil {
-					return fmt.Errorf("could not get facet ID: %v\n", err)
-				}
-			}
+func decodeMetadata(data sql.NullString) (map[string]string, error) {
+	metadata := map[string]string{}
+	if data.Valid {
+		if err := json.Unmarshal([]byte(data.String), &metadata); err != nil {
+			return nil, fmt.Errorf("error decoding document metadata from JSON: %w", err)
+		}
+	}
+	return metadata, nil
+}
 
-			_, err = d.ExecContext(ctx, "INSERT INTO document_facets (document_id, facet_id) VALUES (?, ?)", docid, facetID)
-			if err != nil {
-				return fmt.Errorf("could not insert document_facet: %v\n", err)
-			}
-			return nil
-		})
+// Document is everything stored about one document in the index.
+type Document struct {
+	ID string
+	// Fields holds the searchable text of each field.
+	Fields map[string]string
+	Facets []Facet
+	// Metadata is stored alongside the document and returned with search results, but isn't searched, so it suits things like URLs and dates.
+	Metadata map[string]string
+}
+
+// PutDocument stores a document's fields, replaces its facets and stores its metadata in a single transaction, so a search never sees a document with only some of them updated.
+func (se *FTS) PutDocument(ctx context.Context, doc Document) error {
+	values, err := se.fieldValues(doc.Fields)
+	if err != nil {
+		return err
+	}
+	metadata := doc.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("error encoding document metadata to JSON: %w", err)
+	}
+	return se.db.Write(func(d WriteDBHandler) error {
+		if err := se.putFieldsTx(ctx, d, doc.ID, values); err != nil {
+			return err
+		}
+		if err := replaceFacetsTx(ctx, d, doc.ID, doc.Facets); err != nil {
+			return err
+		}
+		_, err := d.ExecContext(ctx, "INSERT INTO document_metadata (document_id, data) VALUES (?, ?) ON CONFLICT(document_id) DO UPDATE SET data = excluded.data", doc.ID, metadataJSON)
 		if err != nil {
+			return fmt.Errorf("could not store metadata: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetDocument returns everything stored about a document.
+func (se *FTS) GetDocument(ctx context.Context, docid string) (Document, error) {
+	fields, err := se.GetFields(ctx, docid)
+	if err != nil {
+		return Document{}, err
+	}
+	doc := Document{ID: docid, Fields: fields}
+	var metadata sql.NullString
+	err = se.db.QueryRowContext(ctx, "SELECT data FROM document_metadata WHERE document_id = ?", docid).Scan(&metadata)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Document{}, err
+	}
+	if doc.Metadata, err = decodeMetadata(metadata); err != nil {
+		return Document{}, err
+	}
+	rows, err := se.db.QueryContext(ctx, "SELECT f.name, f.value FROM document_facets df JOIN facets f ON df.facet_id = f.id WHERE df.document_id = ? ORDER BY f.name, f.value", docid)
+	if err != nil {
+		return Document{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var facet Facet
+		if err := rows.Scan(&facet.Name, &facet.Value); err != nil {
+			return Document{}, err
+		}
+		doc.Facets = append(doc.Facets, facet)
+	}
+	return doc, rows.Err()
+}
+
+// addFacetsTx associates facets with a document inside an existing write, creating any facets that don't exist yet.
+func addFacetsTx(ctx context.Context, d WriteDBHandler, docid string, facets []Facet) error {
+	for _, facet := range facets {
+		// The no-op update makes RETURNING give the ID of an existing facet too
+		rows, err := d.QueryContext(ctx, "INSERT INTO facets (name, value) VALUES (?, ?) ON CONFLICT(name, value) DO UPDATE SET name = excluded.name RETURNING id", facet.Name, facet.Value)
+		if err != nil {
+			return fmt.Errorf("could not insert facet: %w", err)
+		}
+		var facetID int64
+		if rows.Next() {
+			if err := rows.Scan(&facetID); err != nil {
+				rows.Close()
+				return fmt.Errorf("could not get facet ID: %w", err)
+			}
+		}
+		if err := rows.Close(); err != nil {
 			return err
 		}
+
+		_, err = d.ExecContext(ctx, "INSERT INTO document_facets (document_id, facet_id) VALUES (?, ?) ON CONFLICT(document_id, facet_id) DO NOTHING", docid, facetID)
+		if err != nil {
+			return fmt.Errorf("could not insert document_facet: %w", err)
+		}
 	}
 	return nil
 }
 
+// AddFacets associates facets with a document, all in one write.
+func (se *FTS) AddFacets(ctx context.Context, docid string, facets []Facet) error {
+	return se.db.Write(func(d WriteDBHandler) error {
+		return addFacetsTx(ctx, d, docid, facets)
+	})
+}
+
+func replaceFacetsTx(ctx context.Context, d WriteDBHandler, docid string, facets []Facet) error {
+	if _, err := d.ExecContext(ctx, "DELETE FROM document_facets WHERE document_id = ?", docid); err != nil {
+		return fmt.Errorf("could not remove facets: %w", err)
+	}
+	return addFacetsTx(ctx, d, docid, facets)
+}
+
+// ReplaceFacets makes facets the only facets of a document, in one write.
+func (se *FTS) ReplaceFacets(ctx context.Context, docid string, facets []Facet) error {
+	return se.db.Write(func(d WriteDBHandler) error {
+		return replaceFacetsTx(ctx, d, docid, facets)
+	})
+}
+
+// RemoveFacets removes facets from a document. Facets the document doesn't have are ignored. Facets no longer used by any document are left for GCFacets to remove.
+func (se *FTS) RemoveFacets(ctx context.Context, docid string, facets []Facet) error {
+	return se.db.Write(func(d WriteDBHandler) error {
+		for _, facet := range facets {
+			_, err := d.ExecContext(ctx, "DELETE FROM document_facets WHERE document_id = ? AND facet_id = (SELECT id FROM facets WHERE name = ? AND value = ?)", docid, facet.Name, facet.Value)
+			if err != nil {
+				return fmt.Errorf("could not remove facet: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// GCFacets removes associations with documents that no longer exist, which older versions left behind on delete, and then facets that no document uses. It returns the number of facets removed.
+func (se *FTS) GCFacets(ctx context.Context) (int, error) {
+	var removed int64
+	err := se.db.Write(func(d WriteDBHandler) error {
+		if _, err := d.ExecContext(ctx, "DELETE FROM document_facets WHERE document_id NOT IN (SELECT docid FROM documents)"); err != nil {
+			return fmt.Errorf("could not remove orphaned document facets: %w", err)
+		}
+		result, err := d.ExecContext(ctx, "DELETE FROM facets WHERE id NOT IN (SELECT facet_id FROM document_facets)")
+		if err != nil {
+			return fmt.Errorf("could not remove unused facets: %w", err)
+		}
+		removed, err = result.RowsAffected()
+		return err
+	})
+	return int(removed), err
+}
+
+// GetFacetCounts counts the facets of the given documents. Each docid becomes a query parameter, so for the facets of a whole result set use SearchOptions.CountFacets, which counts them in SQL instead.
 func (se *FTS) GetFacetCounts(ctx context.Context, docIDs []string) ([]FacetCount, error) {
 	if len(docIDs) == 0 {
 		return []FacetCount{}, nil
@@ -180,24 +942,25 @@ func (se *FTS) GetFacetCounts(ctx context.Context, docIDs []string) ([]FacetCoun
 		return nil, err
 	}
 	defer rows.Close()
+	return scanFacetCounts(rows)
+}
 
-	facetCountsMap := make(map[string][]FacetValueCount)
+// scanFacetCounts groups rows of name, value and count, ordered by name, into a FacetCount for each name.
+func scanFacetCounts(rows *sql.Rows) ([]FacetCount, error) {
+	facetCounts := []FacetCount{}
 	for rows.Next() {
 		var name, value string
 		var count int
 		if err := rows.Scan(&name, &value, &count); err != nil {
 			return nil, err
 		}
-
-		facetCountsMap[name] = append(facetCountsMap[name], FacetValueCount{Value: value, Count: count})
-	}
-
-	var facetCounts []FacetCount
-	for name, values := range facetCountsMap {
-		facetCounts = append(facetCounts, FacetCount{Name: name, Values: values})
+		if len(facetCounts) == 0 || facetCounts[len(facetCounts)-1].Name != name {
+			facetCounts = append(facetCounts, FacetCount{Name: name})
+		}
+		last := &facetCounts[len(facetCounts)-1]
+		last.Values = append(last.Values, FacetValueCount{Value: value, Count: count})
 	}
-
-	return facetCounts, nil
+	return facetCounts, rows.Err()
 }
 
 func SortFacetsByTotalDocCount(facets []FacetCount) {
@@ -250,10 +1013,10 @@ func stringsToInterfaces(strings []string) []interface{} {
 }
 
 // Extracts docIDs from search results
-func GetDocIDsFromSearchResults(results []map[string]string) []string {
+func GetDocIDsFromSearchResults(results []SearchResult) []string {
 	var docIDs []string
 	for _, result := range results {
-		docIDs = append(docIDs, result["docid"])
+		docIDs = append(docIDs, result.DocID)
 	}
 	return docIDs
 }
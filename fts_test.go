@@ -4,10 +4,13 @@ package greener_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/thejimmyg/greener"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -93,7 +96,7 @@ func TestSearch(t *testing.T) {
 
 	t.Logf("Search results:\n")
 	for _, result := range results {
-		t.Logf("DocID: %s, Content: %s\n", result["docid"], result["content"])
+		t.Logf("DocID: %s, Content: %s\n", result.DocID, result.Snippet)
 	}
 
 	// Extract docIDs from search results
@@ -131,3 +134,533 @@ func TestSearch(t *testing.T) {
 		t.Errorf("expected an error retrieving a deleted document but didn't get one.\n")
 	}
 }
+
+func TestFTSFields(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	db := newTestBatchDB(t, "fts_fields")
+	se, err := greener.NewFTSWithOptions(ctx, db, greener.FTSOptions{Fields: []greener.FTSField{
+		{Name: "title", Weight: 10},
+		{Name: "body", Weight: 1},
+		{Name: "tags", Weight: 5},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := se.PutFields(ctx, "a", map[string]string{"title": "Minutes", "body": "The annual report was discussed at length, and the report was approved."}); err != nil {
+		t.Fatal(err)
+	}
+	if err := se.PutFields(ctx, "b", map[string]string{"title": "Annual report", "body": "Figures for the year.", "tags": "finance"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := se.PutFields(ctx, "c", map[string]string{"subtitle": "Unknown field"}); err == nil {
+		t.Fatalf("Expected an unknown field to be rejected")
+	}
+
+	results, err := se.Search(ctx, "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docIDs := greener.GetDocIDsFromSearchResults(results); strings.Join(docIDs, ",") != "b,a" {
+		t.Fatalf("Expected the title match to rank first, got %v", docIDs)
+	}
+	results, err = se.Search(ctx, "title:report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docIDs := greener.GetDocIDsFromSearchResults(results); strings.Join(docIDs, ",") != "b" {
+		t.Fatalf("Expected a title scoped search to find only b, got %v", docIDs)
+	}
+
+	fields, err := se.GetFields(ctx, "b")
+	if err != nil || fields["tags"] != "finance" || fields["title"] != "Annual report" {
+		t.Fatalf("Unexpected fields %v %v", fields, err)
+	}
+	reader, err := se.Get(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadAll(reader); string(content) != "Annual report" {
+		t.Fatalf("Expected Get to return the first field, got %q", content)
+	}
+
+	if _, err := greener.NewFTS(ctx, db); err == nil {
+		t.Fatalf("Expected opening the index with different fields to fail")
+	}
+	if _, err := greener.NewFTSWithOptions(ctx, newTestBatchDB(t, "fts_bad_fields"), greener.FTSOptions{Fields: []greener.FTSField{{Name: "docid"}}}); err == nil {
+		t.Fatalf("Expected a field called docid to be rejected")
+	}
+}
+
+func TestFTSDocuments(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	se, err := greener.NewFTS(ctx, newTestBatchDB(t, "fts_documents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := greener.Document{
+		ID:       "post-1",
+		Fields:   map[string]string{"content": "Growing tomatoes in a small garden"},
+		Facets:   []greener.Facet{{"Year", "2023"}, {"Topic", "Gardening"}},
+		Metadata: map[string]string{"url": "/posts/1", "title": "Tomatoes"},
+	}
+	if err := se.PutDocument(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	doc.Facets = []greener.Facet{{"Year", "2024"}, {"Topic", "Gardening"}}
+	doc.Metadata["title"] = "Growing tomatoes"
+	if err := se.PutDocument(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	bad := doc
+	bad.Fields = map[string]string{"unknown": "field"}
+	if err := se.PutDocument(ctx, bad); err == nil {
+		t.Fatalf("Expected a document with an unknown field to be rejected")
+	}
+
+	got, err := se.GetDocument(ctx, "post-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Facets, []greener.Facet{{"Topic", "Gardening"}, {"Year", "2024"}}) || got.Metadata["title"] != "Growing tomatoes" || got.Fields["content"] != doc.Fields["content"] {
+		t.Fatalf("Unexpected document %+v", got)
+	}
+
+	results, err := se.Search(ctx, "tomatoes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].DocID != "post-1" || results[0].Metadata["url"] != "/posts/1" || !strings.Contains(string(results[0].Snippet), "<b>tomatoes</b>") {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+	counts, err := se.GetFacetCounts(ctx, greener.GetDocIDsFromSearchResults(results))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts = greener.OrderFacetsByNames(counts, []string{"Year", "Topic"})
+	want := []greener.FacetCount{
+		{Name: "Year", Values: []greener.FacetValueCount{{Value: "2024", Count: 1}}},
+		{Name: "Topic", Values: []greener.FacetValueCount{{Value: "Gardening", Count: 1}}},
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("Expected replaced facets to be counted once, got %+v", counts)
+	}
+}
+
+func TestFTSFacetLifecycle(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	db := newTestBatchDB(t, "fts_facet_lifecycle")
+	se, err := greener.NewFTS(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if err := se.Put(ctx, id, strings.NewReader("shared words")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := se.AddFacets(ctx, "a", []greener.Facet{{"Tag", "x"}, {"Tag", "x"}, {"Tag", "y"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := se.AddFacets(ctx, "a", []greener.Facet{{"Tag", "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := se.AddFacets(ctx, "b", []greener.Facet{{"Tag", "z"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("AddingAFacetTwiceCountsOnce", func(t *testing.T) {
+		counts, err := se.GetFacetCounts(ctx, []string{"a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(counts) != 1 || len(counts[0].Values) != 2 || counts[0].Values[0].Count != 1 || counts[0].Values[1].Count != 1 {
+			t.Fatalf("Unexpected counts %+v", counts)
+		}
+	})
+
+	t.Run("RemoveAndReplace", func(t *testing.T) {
+		if err := se.RemoveFacets(ctx, "a", []greener.Facet{{"Tag", "y"}, {"Tag", "missing"}}); err != nil {
+			t.Fatal(err)
+		}
+		doc, err := se.GetDocument(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(doc.Facets, []greener.Facet{{"Tag", "x"}}) {
+			t.Fatalf("Unexpected facets after remove %+v", doc.Facets)
+		}
+		if err := se.ReplaceFacets(ctx, "a", []greener.Facet{{"Tag", "w"}}); err != nil {
+			t.Fatal(err)
+		}
+		if doc, err = se.GetDocument(ctx, "a"); err != nil || !reflect.DeepEqual(doc.Facets, []greener.Facet{{"Tag", "w"}}) {
+			t.Fatalf("Unexpected facets after replace %+v %v", doc.Facets, err)
+		}
+	})
+
+	t.Run("DeleteCascadesAndGCRemovesUnusedFacets", func(t *testing.T) {
+		if err := se.Delete(ctx, "b"); err != nil {
+			t.Fatal(err)
+		}
+		counts, err := se.GetFacetCounts(ctx, []string{"b"})
+		if err != nil || len(counts) != 0 {
+			t.Fatalf("Expected no facets for a deleted document, got %+v %v", counts, err)
+		}
+		// x, y and z are no longer used by any document
+		removed, err := se.GCFacets(ctx)
+		if err != nil || removed != 3 {
+			t.Fatalf("Expected 3 unused facets to be removed, got %d %v", removed, err)
+		}
+		if removed, err = se.GCFacets(ctx); err != nil || removed != 0 {
+			t.Fatalf("Expected nothing left to collect, got %d %v", removed, err)
+		}
+	})
+
+	t.Run("ReopenIsIdempotent", func(t *testing.T) {
+		if _, err := greener.NewFTS(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestFTSSearchPages(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	se, err := greener.NewFTS(ctx, newTestBatchDB(t, "fts_search_pages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every document ranks the same, so the order comes from the docid tie break
+	for i := 0; i < 7; i++ {
+		if err := se.Put(ctx, fmt.Sprintf("doc-%d", i), strings.NewReader("paging through results")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := se.Put(ctx, "other", strings.NewReader("unrelated")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Cursor", func(t *testing.T) {
+		var docIDs []string
+		opts := greener.SearchOptions{Limit: 3, CountTotal: true}
+		for pages := 1; ; pages++ {
+			page, err := se.SearchWithOptions(ctx, "paging", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != 7 {
+				t.Fatalf("Expected a total of 7, got %d", page.Total)
+			}
+			docIDs = append(docIDs, greener.GetDocIDsFromSearchResults(page.Results)...)
+			if !page.HasMore {
+				if pages != 3 {
+					t.Fatalf("Expected 3 pages, got %d", pages)
+				}
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+		if strings.Join(docIDs, ",") != "doc-0,doc-1,doc-2,doc-3,doc-4,doc-5,doc-6" {
+			t.Fatalf("Unexpected docids %v", docIDs)
+		}
+	})
+
+	t.Run("Offset", func(t *testing.T) {
+		page, err := se.SearchWithOptions(ctx, "paging", greener.SearchOptions{Limit: 3, Offset: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if docIDs := greener.GetDocIDsFromSearchResults(page.Results); strings.Join(docIDs, ",") != "doc-3,doc-4,doc-5" || !page.HasMore || page.NextOffset != 6 || page.Total != -1 {
+			t.Fatalf("Unexpected page %+v", page)
+		}
+		page, err = se.SearchWithOptions(ctx, "paging", greener.SearchOptions{Limit: 3, Offset: 6})
+		if err != nil || len(page.Results) != 1 || page.HasMore || page.NextCursor != "" {
+			t.Fatalf("Unexpected last page %+v %v", page, err)
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		if _, err := se.SearchWithOptions(ctx, "paging", greener.SearchOptions{Offset: 1, Cursor: "x"}); err == nil {
+			t.Fatalf("Expected offset and cursor together to be rejected")
+		}
+		if _, err := se.SearchWithOptions(ctx, "paging", greener.SearchOptions{Cursor: "!!"}); err == nil {
+			t.Fatalf("Expected an invalid cursor to be rejected")
+		}
+	})
+}
+
+func TestFTSFacetFilters(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	se, err := greener.NewFTS(ctx, newTestBatchDB(t, "fts_facet_filters"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := []greener.Document{
+		{ID: "a", Fields: map[string]string{"content": "garden notes"}, Facets: []greener.Facet{{"Year", "2023"}, {"Topic", "Gardening"}}},
+		{ID: "b", Fields: map[string]string{"content": "garden notes"}, Facets: []greener.Facet{{"Year", "2024"}, {"Topic", "Gardening"}}},
+		{ID: "c", Fields: map[string]string{"content": "garden notes"}, Facets: []greener.Facet{{"Year", "2024"}, {"Topic", "Cooking"}}},
+		{ID: "d", Fields: map[string]string{"content": "garden notes"}, Facets: []greener.Facet{{"Year", "2022"}, {"Topic", "Gardening"}}},
+		{ID: "e", Fields: map[string]string{"content": "kitchen notes"}, Facets: []greener.Facet{{"Year", "2024"}, {"Topic", "Gardening"}}},
+	}
+	for _, doc := range docs {
+		if err := se.PutDocument(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := se.SearchWithOptions(ctx, "garden", greener.SearchOptions{
+		Facets:      []greener.Facet{{"Year", "2023"}, {"Topic", "Gardening"}, {"Year", "2024"}},
+		CountTotal:  true,
+		CountFacets: true,
+		Limit:       1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || len(page.Results) != 1 || !page.HasMore {
+		t.Fatalf("Expected 2 matches across pages, got %+v", page)
+	}
+	want := []greener.FacetCount{
+		{Name: "Topic", Values: []greener.FacetValueCount{{Value: "Gardening", Count: 2}}},
+		{Name: "Year", Values: []greener.FacetValueCount{{Value: "2023", Count: 1}, {Value: "2024", Count: 1}}},
+	}
+	if !reflect.DeepEqual(page.FacetCounts, want) {
+		t.Fatalf("Unexpected facet counts %+v", page.FacetCounts)
+	}
+	next, err := se.SearchWithOptions(ctx, "garden", greener.SearchOptions{Facets: []greener.Facet{{"Year", "2023"}, {"Topic", "Gardening"}, {"Year", "2024"}}, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docIDs := append(greener.GetDocIDsFromSearchResults(page.Results), greener.GetDocIDsFromSearchResults(next.Results)...); strings.Join(docIDs, ",") != "a,b" {
+		t.Fatalf("Expected a and b, got %v", docIDs)
+	}
+
+	page, err = se.SearchWithOptions(ctx, "garden", greener.SearchOptions{CountFacets: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []greener.FacetCount{
+		{Name: "Topic", Values: []greener.FacetValueCount{{Value: "Gardening", Count: 3}, {Value: "Cooking", Count: 1}}},
+		{Name: "Year", Values: []greener.FacetValueCount{{Value: "2024", Count: 2}, {Value: "2022", Count: 1}, {Value: "2023", Count: 1}}},
+	}
+	if len(page.Results) != 4 || !reflect.DeepEqual(page.FacetCounts, want) {
+		t.Fatalf("Unexpected unfiltered page %+v", page)
+	}
+}
+
+func TestFTSTokenizers(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	search := func(t *testing.T, se *greener.FTS, query string, opts greener.SearchOptions) string {
+		t.Helper()
+		page, err := se.SearchWithOptions(ctx, query, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(greener.GetDocIDsFromSearchResults(page.Results), ",")
+	}
+
+	t.Run("RebuildWithPorter", func(t *testing.T) {
+		db := newTestBatchDB(t, "fts_tokenizer_porter")
+		se, err := greener.NewFTS(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := se.PutDocument(ctx, greener.Document{ID: "a", Fields: map[string]string{"content": "She was running late"}, Facets: []greener.Facet{{"Kind", "Note"}}}); err != nil {
+			t.Fatal(err)
+		}
+		if got := search(t, se, "run", greener.SearchOptions{}); got != "" {
+			t.Fatalf("Expected no stemming by default, got %s", got)
+		}
+		if se, err = greener.NewFTSWithOptions(ctx, db, greener.FTSOptions{Tokenizer: greener.FTSTokenizerPorter}); err != nil {
+			t.Fatal(err)
+		}
+		if got := search(t, se, "run", greener.SearchOptions{Facets: []greener.Facet{{"Kind", "Note"}}}); got != "a" {
+			t.Fatalf("Expected the rebuilt index to stem, got %q", got)
+		}
+		if suggestions, err := se.Suggest(ctx, "runn", 5); err != nil || len(suggestions) != 0 {
+			t.Fatalf("Expected suggestions to come from the rebuilt vocabulary of stems, got %+v %v", suggestions, err)
+		}
+		if suggestions, err := se.Suggest(ctx, "ru", 5); err != nil || len(suggestions) != 1 || suggestions[0].Term != "run" {
+			t.Fatalf("Expected the stem run to be suggested, got %+v %v", suggestions, err)
+		}
+		if _, err := greener.NewFTSWithOptions(ctx, db, greener.FTSOptions{Tokenizer: "whitespace"}); err == nil {
+			t.Fatalf("Expected an unknown tokenizer to be rejected")
+		}
+	})
+
+	t.Run("RemoveDiacritics", func(t *testing.T) {
+		se, err := greener.NewFTSWithOptions(ctx, newTestBatchDB(t, "fts_tokenizer_diacritics"), greener.FTSOptions{RemoveDiacritics: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ǘ has two diacritics, which FTS5 only removes with remove_diacritics 2
+		if err := se.Put(ctx, "a", strings.NewReader("Lǘ café")); err != nil {
+			t.Fatal(err)
+		}
+		if got := search(t, se, "lu cafe", greener.SearchOptions{}); got != "a" {
+			t.Fatalf("Expected diacritics to be ignored, got %q", got)
+		}
+	})
+
+	t.Run("Substring", func(t *testing.T) {
+		db := newTestBatchDB(t, "fts_tokenizer_substring")
+		se, err := greener.NewFTS(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := se.Put(ctx, "a", strings.NewReader("Quarterly report")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := se.SearchWithOptions(ctx, "port", greener.SearchOptions{Substring: true}); err == nil {
+			t.Fatalf("Expected substring search to need the substring index")
+		}
+		if se, err = greener.NewFTSWithOptions(ctx, db, greener.FTSOptions{Substring: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := se.Put(ctx, "b", strings.NewReader("Export settings")); err != nil {
+			t.Fatal(err)
+		}
+		if got := search(t, se, "port", greener.SearchOptions{Substring: true}); got != "a,b" && got != "b,a" {
+			t.Fatalf("Expected both documents to contain port, got %q", got)
+		}
+		if got := search(t, se, "port", greener.SearchOptions{}); got != "" {
+			t.Fatalf("Expected the word index not to match part of a word, got %q", got)
+		}
+		if err := se.Delete(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if got := search(t, se, "uarter", greener.SearchOptions{Substring: true}); got != "" {
+			t.Fatalf("Expected deleted documents to be removed from the substring index, got %q", got)
+		}
+		_, err = se.SearchWithOptions(ctx, "po", greener.SearchOptions{Substring: true})
+		var queryErr *greener.FTSQueryError
+		if !errors.As(err, &queryErr) {
+			t.Fatalf("Expected a short substring to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Trigram", func(t *testing.T) {
+		se, err := greener.NewFTSWithOptions(ctx, newTestBatchDB(t, "fts_tokenizer_trigram"), greener.FTSOptions{Tokenizer: greener.FTSTokenizerTrigram})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := se.Put(ctx, "a", strings.NewReader("Quarterly report")); err != nil {
+			t.Fatal(err)
+		}
+		if got := search(t, se, "uarter", greener.SearchOptions{}); got != "a" {
+			t.Fatalf("Expected a trigram index to match part of a word, got %q", got)
+		}
+	})
+}
+
+func TestFTSSnippets(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	se, err := greener.NewFTSWithOptions(ctx, newTestBatchDB(t, "fts_snippets"), greener.FTSOptions{Fields: []greener.FTSField{{Name: "title"}, {Name: "body"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = se.PutFields(ctx, "a", map[string]string{
+		"title": "Tomatoes & <em>friends</em>",
+		"body":  "One two three four five six <script>alert('tomatoes')</script> seven eight nine ten eleven twelve",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snippet := func(t *testing.T, query string, opts greener.SnippetOptions) string {
+		t.Helper()
+		page, err := se.SearchWithOptions(ctx, query, greener.SearchOptions{Snippet: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Results) != 1 {
+			t.Fatalf("Expected one result, got %+v", page.Results)
+		}
+		return string(page.Results[0].Snippet)
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		if got := snippet(t, "body:alert", greener.SnippetOptions{}); got != "One two three four five six &lt;script&gt;<b>alert</b>(&#39;tomatoes&#39;)&lt;/script&gt; seven eight nine ten eleven twelve" {
+			t.Fatalf("Unexpected snippet %s", got)
+		}
+	})
+
+	t.Run("TagsLengthAndEllipsis", func(t *testing.T) {
+		got := snippet(t, "body:alert", greener.SnippetOptions{Open: `<mark class="hit">`, Close: "</mark>", Ellipsis: "…", Tokens: 4})
+		if got != `…script&gt;<mark class="hit">alert</mark>(&#39;tomatoes&#39;)&lt;/script…` {
+			t.Fatalf("Unexpected snippet %s", got)
+		}
+	})
+
+	t.Run("Field", func(t *testing.T) {
+		if got := snippet(t, "tomatoes", greener.SnippetOptions{Field: "title"}); got != "<b>Tomatoes</b> &amp; &lt;em&gt;friends&lt;/em&gt;" {
+			t.Fatalf("Unexpected snippet %s", got)
+		}
+	})
+
+	t.Run("Highlight", func(t *testing.T) {
+		got := snippet(t, "tomatoes OR twelve", greener.SnippetOptions{Field: "body", Highlight: true})
+		if got != "One two three four five six &lt;script&gt;alert(&#39;<b>tomatoes</b>&#39;)&lt;/script&gt; seven eight nine ten eleven <b>twelve</b>" {
+			t.Fatalf("Unexpected highlight %s", got)
+		}
+	})
+
+	t.Run("MarkerLikeTextInDocuments", func(t *testing.T) {
+		// Private use characters, such as icon font glyphs, are stored as they are and escaped like any other text
+		body := "Icons \ue000 injected \ue001\ue001 here \ue002"
+		if err := se.PutFields(ctx, "b", map[string]string{"body": body}); err != nil {
+			t.Fatal(err)
+		}
+		if got := snippet(t, "body:injected", greener.SnippetOptions{}); got != "Icons \ue000 <b>injected</b> \ue001\ue001 here \ue002" {
+			t.Fatalf("Unexpected snippet %q", got)
+		}
+		if got := snippet(t, "body:injected", greener.SnippetOptions{Highlight: true, Field: "body"}); got != "Icons \ue000 <b>injected</b> \ue001\ue001 here \ue002" {
+			t.Fatalf("Unexpected highlight %q", got)
+		}
+		fields, err := se.GetFields(ctx, "b")
+		if err != nil || fields["body"] != body {
+			t.Fatalf("Expected the stored text to be unchanged, got %q %v", fields["body"], err)
+		}
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		if _, err := se.SearchWithOptions(ctx, "tomatoes", greener.SearchOptions{Snippet: greener.SnippetOptions{Field: "summary"}}); err == nil {
+			t.Fatalf("Expected an unknown snippet field to be rejected")
+		}
+		if _, err := se.SearchWithOptions(ctx, "tomatoes", greener.SearchOptions{Snippet: greener.SnippetOptions{Tokens: 65}}); err == nil {
+			t.Fatalf("Expected too many snippet tokens to be rejected")
+		}
+	})
+}
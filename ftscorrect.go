@@ -0,0 +1,141 @@
+package greener
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Correct returns query with any misspelt words replaced by the closest words in the index, for offering "did you mean" links or retrying a search that found nothing. A word is misspelt if no document contains it. Its replacement is the term in the index's vocabulary with the smallest edit distance, counting a swap of two neighbouring letters as one edit, with ties going to the term in the most documents. Words of up to four letters may be one edit away and longer words two. To keep lookups fast only terms starting with the same letter are considered, and words shorter than three letters, words containing digits, prefixes such as rep*, field names and OR are left alone. The rest of the query, including quotes and exclusions, is kept as it is. If nothing needs correcting, query is returned unchanged. It is also returned unchanged by an index using FTSTokenizerPorter, whose vocabulary only has stems such as happi, which are neither close to what was typed nor words worth suggesting.
+func (se *FTS) Correct(ctx context.Context, query string) (string, error) {
+	if se.tokenizer == FTSTokenizerTrigram {
+		return "", fmt.Errorf("spelling correction isn't available for an index using the trigram tokenizer")
+	}
+	if se.tokenizer == FTSTokenizerPorter {
+		return query, nil
+	}
+	fields := map[string]bool{}
+	for _, field := range se.fields {
+		fields[field.Name] = true
+	}
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(query); {
+		r, size := utf8.DecodeRuneInString(query[i:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			i += size
+			continue
+		}
+		start := i
+		for i < len(query) {
+			r, size := utf8.DecodeRuneInString(query[i:])
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				break
+			}
+			i += size
+		}
+		word := query[start:i]
+		next := byte(0)
+		if i < len(query) {
+			next = query[i]
+		}
+		if word == "OR" || next == '*' || (next == ':' && fields[word]) || strings.IndexFunc(word, unicode.IsDigit) >= 0 || utf8.RuneCountInString(word) < 3 {
+			continue
+		}
+		correction, err := se.correctWord(ctx, strings.ToLower(word))
+		if err != nil {
+			return "", err
+		}
+		if correction != "" {
+			b.WriteString(query[last:start])
+			b.WriteString(correction)
+			last = i
+		}
+	}
+	if last == 0 {
+		return query, nil
+	}
+	b.WriteString(query[last:])
+	return b.String(), nil
+}
+
+// correctWord returns the closest term in the vocabulary to a word that isn't in any document, or "" if the word is in a document or nothing is close enough.
+func (se *FTS) correctWord(ctx context.Context, word string) (string, error) {
+	// Matching through the index, rather than looking the word up in the vocabulary, finds words that the tokenizer changes, such as those with diacritics removed
+	rows, err := se.db.QueryContext(ctx, "SELECT 1 FROM documents WHERE documents MATCH ? LIMIT 1", `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	if err != nil {
+		return "", fmt.Errorf("could not check the spelling of %q: %w", word, err)
+	}
+	found := rows.Next()
+	rows.Close()
+	if found {
+		return "", nil
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	target := []rune(word)
+	maxDistance := 2
+	if len(target) <= 4 {
+		maxDistance = 1
+	}
+	first := string(target[0])
+	rows, err = se.db.QueryContext(ctx, "SELECT term, doc FROM documents_vocab WHERE term >= ? AND term <= ? AND length(term) BETWEEN ? AND ?", first, first+"\U0010FFFF", len(target)-maxDistance, len(target)+maxDistance)
+	if err != nil {
+		return "", fmt.Errorf("could not read the vocabulary: %w", err)
+	}
+	defer rows.Close()
+	best, bestDistance, bestDocs := "", maxDistance, 0
+	for rows.Next() {
+		var term string
+		var docs int
+		if err := rows.Scan(&term, &docs); err != nil {
+			return "", err
+		}
+		distance := editDistance(target, []rune(term))
+		if distance > maxDistance {
+			continue
+		}
+		if distance < bestDistance || (distance == bestDistance && docs > bestDocs) {
+			best, bestDistance, bestDocs = term, distance, docs
+		}
+	}
+	return best, rows.Err()
+}
+
+// editDistance returns the number of insertions, deletions, substitutions and swaps of neighbouring characters needed to turn a into b, known as the optimal string alignment distance.
+func editDistance(a, b []rune) int {
+	rows := make([][]int, len(a)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(b)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := rows[i-1][j] + 1
+			if insert := rows[i][j-1] + 1; insert < d {
+				d = insert
+			}
+			if substitute := rows[i-1][j-1] + cost; substitute < d {
+				d = substitute
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				if swap := rows[i-2][j-2] + 1; swap < d {
+					d = swap
+				}
+			}
+			rows[i][j] = d
+		}
+	}
+	return rows[len(a)][len(b)]
+}
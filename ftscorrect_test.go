@@ -0,0 +1,126 @@
+package greener_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestFTSCorrect(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	se, err := greener.NewFTSWithOptions(ctx, newTestBatchDB(t, "fts_correct"), greener.FTSOptions{Fields: []greener.FTSField{{Name: "title"}, {Name: "body"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := map[string]map[string]string{
+		"a": {"title": "Growing tomatoes", "body": "Tomatoes need a sunny garden"},
+		"b": {"title": "Garden planning", "body": "Plan the garden before planting tomatoes"},
+		"c": {"title": "Tomato soup", "body": "A warming recipe"},
+		"d": {"title": "Gardening in 2024", "body": "Receive a garden guide"},
+	}
+	for id, fields := range docs {
+		if err := se.PutFields(ctx, id, fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"Substitution", "tomatoes gardan", "tomatoes garden"},
+		{"FrequencyBreaksTies", "tomatos", "tomatoes"},
+		{"Transposition", "recieve", "receive"},
+		{"SyntaxIsKept", `-title:"gardne planing" OR Soop`, `-title:"garden planning" OR soup`},
+		{"CorrectWordsAreKept", "garden tomato", "garden tomato"},
+		{"NothingClose", "zebra", "zebra"},
+		{"SkippedWords", "gardn* 2O24 in", "gardn* 2O24 in"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := se.Correct(ctx, tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Fatalf("Correct(%q) = %q, expected %q", tc.input, got, tc.expected)
+			}
+		})
+	}
+
+	t.Run("SearchRetries", func(t *testing.T) {
+		page, err := se.SearchWithOptions(ctx, "tomatos sunny", greener.SearchOptions{Correct: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.CorrectedQuery != "tomatoes sunny" || strings.Join(greener.GetDocIDsFromSearchResults(page.Results), ",") != "a" {
+			t.Fatalf("Unexpected corrected page %+v", page)
+		}
+		page, err = se.SearchWithOptions(ctx, "tomatos sunny", greener.SearchOptions{})
+		if err != nil || len(page.Results) != 0 || page.CorrectedQuery != "" {
+			t.Fatalf("Expected no retry without Correct, got %+v %v", page, err)
+		}
+		page, err = se.SearchWithOptions(ctx, "garden", greener.SearchOptions{Correct: true})
+		if err != nil || len(page.Results) != 3 || page.CorrectedQuery != "" {
+			t.Fatalf("Expected no correction when there are results, got %+v %v", page, err)
+		}
+	})
+
+	t.Run("NothingBeyondTheLimit", func(t *testing.T) {
+		content, err := greener.NewFTS(ctx, newTestBatchDB(t, "fts_correct_limit"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := content.Put(ctx, "a", strings.NewReader("The cat sat")); err != nil {
+			t.Fatal(err)
+		}
+		// title is three edits from the, one more than a five letter word may have
+		got, err := content.Correct(ctx, "title:foo")
+		if err != nil || got != "title:foo" {
+			t.Fatalf("Expected no correction, got %q %v", got, err)
+		}
+	})
+
+	t.Run("PorterIsLeftAlone", func(t *testing.T) {
+		porter, err := greener.NewFTSWithOptions(ctx, newTestBatchDB(t, "fts_correct_porter"), greener.FTSOptions{Tokenizer: greener.FTSTokenizerPorter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := porter.Put(ctx, "a", strings.NewReader("Happiness is running")); err != nil {
+			t.Fatal(err)
+		}
+		// The vocabulary only has stems such as happi and run, which mustn't be offered as corrections
+		got, err := porter.Correct(ctx, "hapiness runing")
+		if err != nil || got != "hapiness runing" {
+			t.Fatalf("Expected the query to be unchanged, got %q %v", got, err)
+		}
+		page, err := porter.SearchWithOptions(ctx, "hapiness", greener.SearchOptions{Correct: true})
+		if err != nil || len(page.Results) != 0 || page.CorrectedQuery != "" {
+			t.Fatalf("Expected no retry, got %+v %v", page, err)
+		}
+	})
+
+	t.Run("TrigramIsLeftAlone", func(t *testing.T) {
+		trigram, err := greener.NewFTSWithOptions(ctx, newTestBatchDB(t, "fts_correct_trigram"), greener.FTSOptions{Tokenizer: greener.FTSTokenizerTrigram})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := trigram.Put(ctx, "a", strings.NewReader("Growing tomatoes")); err != nil {
+			t.Fatal(err)
+		}
+		page, err := trigram.SearchWithOptions(ctx, "tomatos", greener.SearchOptions{Correct: true})
+		if err != nil || len(page.Results) != 0 || page.CorrectedQuery != "" {
+			t.Fatalf("Expected an empty page rather than a correction error, got %+v %v", page, err)
+		}
+	})
+}
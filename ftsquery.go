@@ -0,0 +1,212 @@
+package greener
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FTSQueryError describes why a search query couldn't be parsed. Pos is the byte offset in the query where the problem was found.
+type FTSQueryError struct {
+	Query   string
+	Pos     int
+	Message string
+}
+
+func (e *FTSQueryError) Error() string {
+	return fmt.Sprintf("invalid search query at position %d: %s", e.Pos, e.Message)
+}
+
+// ftsQueryTerm is one term, phrase or prefix in a parsed query, already rendered as FTS5 syntax.
+type ftsQueryTerm struct {
+	expr    string
+	exclude bool
+}
+
+// ParseQuery turns what a user typed into a search box into an FTS5 expression that can safely be passed to MATCH. Words must all match, "quoted phrases" must match in order, term* matches any word starting with term, -term excludes documents that match, a OR b matches either, and field:term or field:"a phrase" only matches in that field. Anything else, including FTS5 operators such as NEAR, AND and NOT and any punctuation, is treated as plain text. A prefix that isn't one of the index's fields is treated as plain text too, so a query such as "meeting at 10:30" still works.
+func (se *FTS) ParseQuery(query string) (string, error) {
+	fields := map[string]bool{}
+	for _, field := range se.fields {
+		fields[field.Name] = true
+	}
+	fail := func(pos int, format string, args ...interface{}) (string, error) {
+		return "", &FTSQueryError{Query: query, Pos: pos, Message: fmt.Sprintf(format, args...)}
+	}
+
+	var groups [][]ftsQueryTerm
+	var excluded []ftsQueryTerm
+	orPos := -1
+	i := 0
+	for {
+		for i < len(query) && isFTSQuerySpace(query[i]) {
+			i++
+		}
+		if i >= len(query) {
+			break
+		}
+		start := i
+		exclude := false
+		if query[i] == '-' {
+			exclude = true
+			i++
+			if i >= len(query) || isFTSQuerySpace(query[i]) {
+				// A dash on its own isn't an exclusion, just punctuation
+				continue
+			}
+		}
+		field := ""
+		if colon := strings.IndexByte(query[i:], ':'); colon > 0 && fields[query[i:i+colon]] {
+			field = query[i : i+colon]
+			i += colon + 1
+			if i >= len(query) || isFTSQuerySpace(query[i]) {
+				return fail(start, "%s: must be followed by a term or a phrase", field)
+			}
+		}
+
+		var text string
+		if query[i] == '"' {
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				return fail(i, "missing closing quote")
+			}
+			text = query[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			end := i
+			for end < len(query) && !isFTSQuerySpace(query[end]) && query[end] != '"' {
+				end++
+			}
+			text = query[i:end]
+			i = end
+			if text == "OR" && !exclude && field == "" {
+				if orPos >= 0 {
+					return fail(start, "OR can't follow another OR")
+				}
+				if len(groups) == 0 {
+					return fail(start, "OR must come between two terms")
+				}
+				orPos = start
+				continue
+			}
+		}
+		prefix := false
+		if i < len(query) && query[i] == '*' {
+			prefix = true
+			for i < len(query) && query[i] == '*' {
+				i++
+			}
+		} else if trimmed := strings.TrimRight(text, "*"); trimmed != text {
+			prefix = true
+			text = trimmed
+		}
+		if !hasFTSQueryToken(text) {
+			if prefix {
+				return fail(start, "* must follow a term")
+			}
+			// Punctuation on its own matches nothing, so leave it out rather than failing the whole search
+			continue
+		}
+
+		term := ftsQueryTerm{expr: `"` + strings.ReplaceAll(text, `"`, `""`) + `"`, exclude: exclude}
+		if prefix {
+			term.expr += "*"
+		}
+		if field != "" {
+			term.expr = field + ":" + term.expr
+		}
+		switch {
+		case orPos >= 0 && exclude:
+			return fail(start, "an excluded term can't be part of an OR")
+		case orPos >= 0:
+			groups[len(groups)-1] = append(groups[len(groups)-1], term)
+			orPos = -1
+		case exclude:
+			excluded = append(excluded, term)
+		default:
+			groups = append(groups, []ftsQueryTerm{term})
+		}
+	}
+	if orPos >= 0 {
+		return fail(orPos, "OR must come between two terms")
+	}
+	if len(groups) == 0 {
+		if len(excluded) > 0 {
+			return fail(0, "a search needs at least one term that isn't excluded")
+		}
+		return fail(0, "the search has no words to search for")
+	}
+
+	parts := make([]string, len(groups))
+	for i, group := range groups {
+		exprs := make([]string, len(group))
+		for j, term := range group {
+			exprs[j] = term.expr
+		}
+		parts[i] = strings.Join(exprs, " OR ")
+		if len(group) > 1 {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	expr := strings.Join(parts, " AND ")
+	if len(excluded) > 0 {
+		if len(parts) > 1 {
+			expr = "(" + expr + ")"
+		}
+		for _, term := range excluded {
+			expr += " NOT " + term.expr
+		}
+	}
+	return expr, nil
+}
+
+func isFTSQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// hasFTSQueryToken reports whether text contains anything the tokenizer would index.
+func hasFTSQueryToken(text string) bool {
+	return strings.IndexFunc(text, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) >= 0
+}
+
+// ParseSubstringQuery turns search box input into an FTS5 expression for the trigram index used by SearchOptions.Substring. Each word, or "quoted phrase", must appear somewhere in the document, even in the middle of a word, and must be at least three characters long because shorter text can't be looked up in a trigram index.
+func ParseSubstringQuery(query string) (string, error) {
+	fail := func(pos int, format string, args ...interface{}) (string, error) {
+		return "", &FTSQueryError{Query: query, Pos: pos, Message: fmt.Sprintf(format, args...)}
+	}
+	var terms []string
+	i := 0
+	for {
+		for i < len(query) && isFTSQuerySpace(query[i]) {
+			i++
+		}
+		if i >= len(query) {
+			break
+		}
+		start := i
+		var text string
+		if query[i] == '"' {
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				return fail(i, "missing closing quote")
+			}
+			text = query[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			for i < len(query) && !isFTSQuerySpace(query[i]) && query[i] != '"' {
+				i++
+			}
+			text = query[start:i]
+		}
+		if utf8.RuneCountInString(text) < 3 {
+			return fail(start, "%q is too short, substring searches need at least three characters", text)
+		}
+		terms = append(terms, `"`+strings.ReplaceAll(text, `"`, `""`)+`"`)
+	}
+	if len(terms) == 0 {
+		return fail(0, "the search has no words to search for")
+	}
+	return strings.Join(terms, " AND "), nil
+}
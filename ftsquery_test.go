@@ -0,0 +1,119 @@
+package greener_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestFTSParseQuery(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	se, err := greener.NewFTSWithOptions(ctx, newTestBatchDB(t, "fts_parse_query"), greener.FTSOptions{Fields: []greener.FTSField{{Name: "title"}, {Name: "body"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"Words", "annual report", `"annual" AND "report"`},
+		{"Phrase", `"annual report" 2024`, `"annual report" AND "2024"`},
+		{"Prefix", "rep* \"annual re\"*", `"rep"* AND "annual re"*`},
+		{"Exclusion", "report -draft -\"first cut\"", `"report" NOT "draft" NOT "first cut"`},
+		{"ExclusionAfterGroups", "annual report -draft", `("annual" AND "report") NOT "draft"`},
+		{"Or", "tomato OR potato soup", `("tomato" OR "potato") AND "soup"`},
+		{"LowerCaseOrIsAWord", "this or that", `"this" AND "or" AND "that"`},
+		{"Field", `title:report body:"year end"`, `title:"report" AND body:"year end"`},
+		{"UnknownFieldIsText", "meeting at 10:30 author:jim", `"meeting" AND "at" AND "10:30" AND "author:jim"`},
+		{"OperatorsAreText", "NEAR(a b) AND NOT c", `"NEAR(a" AND "b)" AND "AND" AND "NOT" AND "c"`},
+		{"Punctuation", `cats & dogs - e-mail`, `"cats" AND "dogs" AND "e-mail"`},
+		{"QuotesInsideWords", `it's 5'11`, `"it's" AND "5'11"`},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := se.ParseQuery(tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Fatalf("ParseQuery(%q) = %s, expected %s", tc.input, got, tc.expected)
+			}
+		})
+	}
+
+	errorCases := []struct {
+		name  string
+		input string
+		pos   int
+	}{
+		{"Empty", "  ", 0},
+		{"OnlyPunctuation", "& !", 0},
+		{"UnclosedQuote", `report "annual`, 7},
+		{"LeadingOr", "OR report", 0},
+		{"TrailingOr", "report OR", 7},
+		{"DoubleOr", "a OR OR b", 5},
+		{"OrExclusion", "a OR -b", 5},
+		{"OnlyExclusions", "-draft", 0},
+		{"LonePrefix", "report *", 7},
+		{"EmptyField", "title: report", 0},
+	}
+	for _, tc := range errorCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := se.ParseQuery(tc.input)
+			var queryErr *greener.FTSQueryError
+			if !errors.As(err, &queryErr) {
+				t.Fatalf("Expected an FTSQueryError for %q, got %v", tc.input, err)
+			}
+			if queryErr.Pos != tc.pos {
+				t.Fatalf("Expected the error at position %d, got %v", tc.pos, err)
+			}
+		})
+	}
+
+	t.Run("Search", func(t *testing.T) {
+		if err := se.PutFields(ctx, "a", map[string]string{"title": "Annual report", "body": "Don't panic: the figures are \"final\"."}); err != nil {
+			t.Fatal(err)
+		}
+		if err := se.PutFields(ctx, "b", map[string]string{"title": "Draft report", "body": "NEAR the end"}); err != nil {
+			t.Fatal(err)
+		}
+		for query, expected := range map[string]string{
+			`report -draft`:       "a",
+			`"the figures" don't`: "a",
+			`NEAR(`:               "b",
+			`title:dra*`:          "b",
+			`annual OR draft`:     "a,b",
+		} {
+			results, err := se.Search(ctx, query)
+			if err != nil {
+				t.Fatalf("Search(%q) failed: %v", query, err)
+			}
+			docIDs := greener.GetDocIDsFromSearchResults(results)
+			sort.Strings(docIDs)
+			if strings.Join(docIDs, ",") != expected {
+				t.Fatalf("Search(%q) found %v, expected %s", query, docIDs, expected)
+			}
+		}
+		if _, err := se.SearchWithOptions(ctx, "NEAR(", greener.SearchOptions{Raw: true}); err == nil {
+			t.Fatalf("Expected invalid raw FTS5 syntax to fail")
+		}
+		page, err := se.SearchWithOptions(ctx, "report NOT title:annual", greener.SearchOptions{Raw: true})
+		if err != nil || len(page.Results) != 1 || page.Results[0].DocID != "b" {
+			t.Fatalf("Unexpected raw search results %+v %v", page, err)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package greener
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Suggestion is a term from the index that completes a prefix.
+type Suggestion struct {
+	Term string `json:"term"`
+	// Docs is the number of documents containing the term.
+	Docs int `json:"docs"`
+}
+
+// SuggestOptions controls the suggestions returned by SuggestWithOptions.
+type SuggestOptions struct {
+	// Limit is the maximum number of suggestions. Defaults to 10.
+	Limit int
+	// Alphabetical orders suggestions by term instead of putting the terms found in the most documents first.
+	Alphabetical bool
+}
+
+func (o SuggestOptions) withDefaults() SuggestOptions {
+	if o.Limit <= 0 {
+		o.Limit = 10
+	}
+	return o
+}
+
+// Suggest returns up to limit terms in the index that start with prefix, most common first, for completing a word as it is typed. Terms are read from the index's vocabulary, so they are lower case and, with FTSTokenizerPorter, are stems such as "run" rather than the words in the documents.
+func (se *FTS) Suggest(ctx context.Context, prefix string, limit int) ([]Suggestion, error) {
+	return se.SuggestWithOptions(ctx, prefix, SuggestOptions{Limit: limit})
+}
+
+// SuggestWithOptions returns the terms in the index that start with prefix, as described by opts.
+func (se *FTS) SuggestWithOptions(ctx context.Context, prefix string, opts SuggestOptions) ([]Suggestion, error) {
+	if se.tokenizer == FTSTokenizerTrigram {
+		return nil, fmt.Errorf("suggestions aren't available for an index using the trigram tokenizer")
+	}
+	opts = opts.withDefaults()
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	suggestions := []Suggestion{}
+	if prefix == "" {
+		return suggestions, nil
+	}
+	order := "doc DESC, term"
+	if opts.Alphabetical {
+		order = "term"
+	}
+	// U+10FFFF sorts after anything that can follow the prefix, and the range lets fts5vocab skip straight to the prefix
+	rows, err := se.db.QueryContext(ctx, "SELECT term, doc FROM documents_vocab WHERE term >= ? AND term <= ? ORDER BY "+order+" LIMIT ?", prefix, prefix+"\U0010FFFF", opts.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not read suggestions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var suggestion Suggestion
+		if err := rows.Scan(&suggestion.Term, &suggestion.Docs); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	return suggestions, rows.Err()
+}
+
+// SuggestHandler serves suggestions for search-as-you-type as JSON. A GET request with the search box text as the q parameter, and optionally a limit, returns completions of its last word:
+//
+//	GET /?q=annual+rep  {"suggestions":[{"term":"report","docs":12,"text":"annual report"}]}
+//
+// Text is the whole query with the last word completed. Nothing is suggested once the last word has been finished with a space. SuggestUISupport wires a search input to the handler.
+type SuggestHandler struct {
+	fts      *FTS
+	maxLimit int
+}
+
+// NewSuggestHandler creates a SuggestHandler that returns at most maxLimit suggestions, which is also the default limit.
+func NewSuggestHandler(fts *FTS, maxLimit int) *SuggestHandler {
+	if maxLimit <= 0 {
+		maxLimit = 10
+	}
+	return &SuggestHandler{fts: fts, maxLimit: maxLimit}
+}
+
+type suggestResponse struct {
+	Suggestions []suggestResponseItem `json:"suggestions"`
+}
+
+type suggestResponseItem struct {
+	Suggestion
+	Text string `json:"text"`
+}
+
+func (h *SuggestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := h.maxLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if parsed < limit {
+			limit = parsed
+		}
+	}
+	query := r.URL.Query().Get("q")
+	// The last word, without any quote or exclusion in front of it
+	start := 0
+	if i := strings.LastIndexFunc(query, unicode.IsSpace); i >= 0 {
+		// Spaces such as U+00A0 from mobile keyboards are more than one byte
+		_, width := utf8.DecodeRuneInString(query[i:])
+		start = i + width
+	}
+	for start < len(query) && (query[start] == '"' || query[start] == '-') {
+		start++
+	}
+	if colon := strings.LastIndexByte(query[start:], ':'); colon >= 0 {
+		start += colon + 1
+	}
+	response := suggestResponse{Suggestions: []suggestResponseItem{}}
+	if start < len(query) {
+		suggestions, err := h.fts.Suggest(r.Context(), query[start:], limit)
+		if err != nil {
+			http.Error(w, "Failed to get suggestions", http.StatusInternalServerError)
+			return
+		}
+		for _, suggestion := range suggestions {
+			response.Suggestions = append(response.Suggestions, suggestResponseItem{Suggestion: suggestion, Text: query[:start] + suggestion.Term})
+		}
+	}
+	writeKVJSON(w, http.StatusOK, response)
+}
+
+// SuggestUISupport adds suggestions to any input with a data-suggest attribute giving the URL of a SuggestHandler, such as <input type="search" name="q" data-suggest="/suggest">. As the user types, suggestions are fetched and offered through a datalist.
+var SuggestUISupport []UISupport
+
+func init() {
+	SuggestUISupport = append(SuggestUISupport, NewDefaultUISupport(
+		"",
+		`
+(function () {
+    function setUpSuggestions() {
+        document.querySelectorAll('input[data-suggest]').forEach(function (input, i) {
+            var list = document.createElement('datalist');
+            list.id = 'suggest-' + i;
+            input.setAttribute('list', list.id);
+            input.setAttribute('autocomplete', 'off');
+            input.after(list);
+            var timer, controller;
+            input.addEventListener('input', function () {
+                clearTimeout(timer);
+                // Wait for a pause in typing rather than fetching on every key press
+                timer = setTimeout(function () {
+                    if (controller) {
+                        controller.abort();
+                    }
+                    controller = new AbortController();
+                    var url = new URL(input.dataset.suggest, location.href);
+                    url.searchParams.set('q', input.value);
+                    fetch(url, {signal: controller.signal})
+                        .then(function (response) { return response.ok ? response.json() : {suggestions: []}; })
+                        .then(function (data) {
+                            list.replaceChildren.apply(list, data.suggestions.map(function (suggestion) {
+                                var option = document.createElement('option');
+                                option.value = suggestion.text;
+                                return option;
+                            }));
+                        })
+                        .catch(function () {});
+                }, 150);
+            });
+        });
+    }
+    if (document.readyState === 'loading') {
+        document.addEventListener('DOMContentLoaded', setUpSuggestions);
+    } else {
+        setUpSuggestions();
+    }
+})();
+`,
+		"",
+	))
+}
@@ -0,0 +1,118 @@
+package greener_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestFTSSuggest(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	se, err := greener.NewFTS(ctx, newTestBatchDB(t, "fts_suggest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, content := range map[string]string{
+		"a": "Annual report",
+		"b": "Report on repairs",
+		"c": "Reports and more reports",
+		"d": "Repeat after me",
+	} {
+		if err := se.Put(ctx, id, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("ByPopularity", func(t *testing.T) {
+		suggestions, err := se.Suggest(ctx, "Rep", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []greener.Suggestion{{Term: "report", Docs: 2}, {Term: "repairs", Docs: 1}, {Term: "repeat", Docs: 1}}
+		if !reflect.DeepEqual(suggestions, want) {
+			t.Fatalf("Unexpected suggestions %+v", suggestions)
+		}
+	})
+
+	t.Run("Alphabetical", func(t *testing.T) {
+		suggestions, err := se.SuggestWithOptions(ctx, "rep", greener.SuggestOptions{Alphabetical: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var terms []string
+		for _, suggestion := range suggestions {
+			terms = append(terms, suggestion.Term)
+		}
+		if strings.Join(terms, ",") != "repairs,repeat,report,reports" {
+			t.Fatalf("Unexpected suggestions %v", terms)
+		}
+	})
+
+	t.Run("NoMatches", func(t *testing.T) {
+		for _, prefix := range []string{"zzz", " "} {
+			suggestions, err := se.Suggest(ctx, prefix, 5)
+			if err != nil || len(suggestions) != 0 {
+				t.Fatalf("Expected no suggestions for %q, got %+v %v", prefix, suggestions, err)
+			}
+		}
+	})
+
+	t.Run("Handler", func(t *testing.T) {
+		handler := greener.NewSuggestHandler(se, 2)
+		get := func(path string) (int, []string) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			var body struct {
+				Suggestions []struct {
+					Text string `json:"text"`
+				} `json:"suggestions"`
+			}
+			if rec.Code == http.StatusOK {
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var texts []string
+			for _, suggestion := range body.Suggestions {
+				texts = append(texts, suggestion.Text)
+			}
+			return rec.Code, texts
+		}
+		if code, texts := get("/?q=annual+-title:rep&limit=10"); code != http.StatusOK || strings.Join(texts, "|") != "annual -title:report|annual -title:repairs" {
+			t.Fatalf("Unexpected response %d %v", code, texts)
+		}
+		if code, texts := get("/?q=annual+%22rep&limit=1"); code != http.StatusOK || strings.Join(texts, "|") != `annual "report` {
+			t.Fatalf("Unexpected response %d %v", code, texts)
+		}
+		for _, space := range []string{"\u00a0", "\u3000", "\u2003"} {
+			if code, texts := get("/?limit=1&q=" + url.QueryEscape("annual"+space+"rep")); code != http.StatusOK || strings.Join(texts, "|") != "annual"+space+"report" {
+				t.Fatalf("Unexpected response after a non-ASCII space %d %q", code, texts)
+			}
+		}
+		if code, texts := get("/?q=report+"); code != http.StatusOK || len(texts) != 0 {
+			t.Fatalf("Expected no suggestions after a finished word, got %d %v", code, texts)
+		}
+		if code, _ := get("/?q=rep&limit=x"); code != http.StatusBadRequest {
+			t.Fatalf("Expected an invalid limit to be rejected, got %d", code)
+		}
+	})
+
+	t.Run("UISupport", func(t *testing.T) {
+		if len(greener.SuggestUISupport) != 1 || !strings.Contains(greener.SuggestUISupport[0].Script(), "data-suggest") {
+			t.Fatalf("Expected a script that wires up data-suggest inputs")
+		}
+	})
+}
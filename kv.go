@@ -1,15 +1,21 @@
 // rm kvstore.db; go run cmd/kvstore/main.go
 // Note: If you make create/drop tables outside of this code, it won't notice until you restart. You therefore shouldn't do that.
-// Also an application should only have one KV, otherwise the mutex won't behave correclty and you may get database is locked errors due to multiple writers.
+// Several KVs can share one BatchDB by using NewKVTable with different table names, since all their writes still go through the BatchDB's single writer.
 
 package greener
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -57,27 +63,70 @@ type Row struct {
 	Data    JSONValue
 }
 
-// KvStore is the interface defining the key value store operations.
+// ErrKVNotFound is returned when a row doesn't exist or has expired.
+var ErrKVNotFound = errors.New("no matching row found")
+
+// ErrKVExists is returned by Create when an unexpired row with the same pk and sk already exists.
+var ErrKVExists = errors.New("row already exists")
+
+// KvStore is the interface defining the key value store operations. It is implemented by KV, which stores rows in SQLite, and by MemoryKV, which keeps them in memory.
 type KvStore interface {
-	Create(pk string, sk string, data JSONValue, expires *time.Time) error
-	Put(pk string, sk string, data JSONValue, expires *time.Time) error
-	Delete(pk, sk string) error
-	Iterate(pk, skStart string, limit int, after string) ([]Row, string, error)
-	Get(pk, sk string) (JSONValue, *time.Time, error)
+	Create(ctx context.Context, pk string, sk string, data JSONValue, expires *time.Time) error
+	Put(ctx context.Context, pk string, sk string, data JSONValue, expires *time.Time) error
+	Delete(ctx context.Context, pk string, sk string) error
+	Get(ctx context.Context, pk string, sk string) (JSONValue, *time.Time, error)
+	Iterate(ctx context.Context, pk, sk string, limit int, after bool) ([]Row, string, error)
+	Query(ctx context.Context, pk string, q KVQuery) ([]Row, KVCursor, error)
+	Increment(ctx context.Context, pk string, sk string, field string, delta float64) (JSONValue, error)
+	Patch(ctx context.Context, pk string, sk string, patch JSONMergePatch) (JSONValue, error)
 }
 
+var _ KvStore = (*KV)(nil)
+
 // KV keeps track of KVstore tables and manages the database connection.
 type KV struct {
-	db DB
+	db            DB
+	table         string
+	cursorSecret  atomic.Pointer[string]
+	watchers      kvWatchers
+	historyPolicy atomic.Pointer[KVHistoryPolicy]
+	// historyPrunedID is the highest history id whose row has already been checked against KeepVersions
+	historyPrunedID atomic.Int64
+	cache           atomic.Pointer[kvCache]
+}
+
+// kvTableNamePattern matches the table names NewKVTable accepts. They are interpolated into SQL so must never contain quotes, spaces or punctuation.
+var kvTableNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,62}$`)
+
+// ValidateKVTableName returns an error if name can't safely be used as a KV table name.
+func ValidateKVTableName(name string) error {
+	if !kvTableNamePattern.MatchString(name) || strings.HasPrefix(strings.ToLower(name), "sqlite_") {
+		return fmt.Errorf("invalid KV table name %q: must start with a letter, contain only letters, digits and underscores, be at most 63 characters and not start with sqlite_", name)
+	}
+	return nil
 }
 
-// NewKV initializes and returns a new KV.
+// NewKV initializes and returns a new KV using the default "kv" table.
 func NewKV(ctx context.Context, db DB) (*KV, error) {
+	return NewKVTable(ctx, db, "kv")
+}
+
+// NewKVTable initializes and returns a KV stored in its own table, so that one BatchDB can host several isolated stores such as sessions, cache and settings. Each KV needs its own cleanup routine.
+func NewKVTable(ctx context.Context, db DB, name string) (*KV, error) {
+	if err := ValidateKVTableName(name); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate cursor secret: %w", err)
+	}
 	tm := &KV{
-		db: db,
+		db:    db,
+		table: name,
 	}
+	tm.SetCursorSecret(string(secret))
 	err := tm.db.Write(func(writeDB WriteDBHandler) error {
-		tableName := "kv"
+		tableName := tm.table
 		createTableSQL := fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS %s (
 		    pk TEXT NOT NULL,
@@ -98,40 +147,20 @@ func NewKV(ctx context.Context, db DB) (*KV, error) {
 	return tm, nil
 }
 
-// StartCleanupRoutine runs a goroutine that periodically deletes expired rows from KVstore tables.
+// StartCleanupRoutine runs a goroutine that deletes expired rows from the KV's table every 60 seconds until ctx is done. Use StartExpiry for more control.
 func (tm *KV) StartCleanupRoutine(ctx context.Context) {
-	ticker := time.NewTicker(60 * time.Second)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				now := time.Now().Unix()
-				tableName := "kv"
-				err := tm.db.Write(func(writeDB WriteDBHandler) error {
-					_, err := writeDB.ExecContext(ctx, "DELETE FROM "+tableName+" WHERE expires IS NOT NULL AND expires < ?", now)
-					return err
-				})
-				if err != nil {
-					log.Printf("Error cleaning up expired rows in table %s: %v", tableName, err)
-				}
-			}
-		}
-	}()
+	tm.StartExpiry(ctx, KVExpiryOptions{})
 }
 
 func (tm *KV) putOrCreate(ctx context.Context, pk string, sk string, data JSONValue, expires *time.Time, allowUpdate bool) error {
 
-	tableName := "kv"
+	tableName := tm.table
 	changed := true
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return fmt.Errorf("error encoding data to JSON: %w", err)
 	}
-	var expiresUnix *int64
-	if expires != nil {
-		unix := expires.Unix()
-		expiresUnix = &unix
-	}
+	expiresUnix := expiresToDB(expires)
 	err = tm.db.Write(func(writeDB WriteDBHandler) error {
 		if allowUpdate {
 			upsertSQL := fmt.Sprintf(`
@@ -144,11 +173,13 @@ func (tm *KV) putOrCreate(ctx context.Context, pk string, sk string, data JSONVa
 			}
 			return nil
 		} else {
+			// An expired row that hasn't been cleaned up yet doesn't count as existing
 			insertSQL := fmt.Sprintf(`
         	    INSERT INTO %s (pk, sk, data, expires) VALUES (?, ?, ?, ?)
-        	    ON CONFLICT(pk, sk) DO NOTHING;
+        	    ON CONFLICT(pk, sk) DO UPDATE SET data=excluded.data, expires=excluded.expires
+        	    WHERE expires IS NOT NULL AND expires <= ?;
         	`, tableName)
-			result, err := writeDB.ExecContext(ctx, insertSQL, pk, sk, jsonData, expiresUnix)
+			result, err := writeDB.ExecContext(ctx, insertSQL, pk, sk, jsonData, expiresUnix, kvNow())
 			if err != nil {
 				return fmt.Errorf("failed to insert row in table %s: %w", tableName, err)
 			}
@@ -169,35 +200,252 @@ func (tm *KV) putOrCreate(ctx context.Context, pk string, sk string, data JSONVa
 	}
 	if !allowUpdate && !changed {
 		// The create failed
-		return fmt.Errorf("row with pk %s and sk %s already exists", pk, sk)
+		return fmt.Errorf("%w: pk %s and sk %s", ErrKVExists, pk, sk)
 	}
+	tm.committed(KVEvent{Type: KVEventPut, PK: pk, SK: sk, Data: data, Expires: expires})
 	return nil
 }
 
+// kvETag returns a hash of the canonical JSON encoding of data, suitable for use as an HTTP ETag.
+func kvETag(data JSONValue) (string, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("error encoding data to JSON: %w", err)
+	}
+	return hashContentWithSalt(jsonData, ""), nil
+}
+
+// writeIf reads the current unexpired value of a row inside the write transaction and passes it (or nil if there isn't one) to check. If check returns true the row is replaced with data and expires, or deleted if data is nil, in the same transaction. It returns the value check saw and whether the write was applied.
+func (tm *KV) writeIf(ctx context.Context, pk string, sk string, data JSONValue, expires *time.Time, check func(current JSONValue) bool) (JSONValue, bool, error) {
+	tableName := tm.table
+	var jsonData []byte
+	var err error
+	if data != nil {
+		jsonData, err = json.Marshal(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("error encoding data to JSON: %w", err)
+		}
+	}
+	expiresUnix := expiresToDB(expires)
+	var current JSONValue
+	applied := false
+	err = tm.db.Write(func(writeDB WriteDBHandler) error {
+		current = nil
+		applied = false
+		rows, err := writeDB.QueryContext(ctx, fmt.Sprintf("SELECT data FROM %s WHERE pk = ? AND sk = ? AND (expires IS NULL OR expires > ?)", tableName), pk, sk, kvNow())
+		if err != nil {
+			return fmt.Errorf("error querying for row: %w", err)
+		}
+		var currentJSON string
+		found := rows.Next()
+		if found {
+			if err := rows.Scan(&currentJSON); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning row: %w", err)
+			}
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		if found {
+			if err := json.Unmarshal([]byte(currentJSON), &current); err != nil {
+				return fmt.Errorf("error decoding data from JSON: %w", err)
+			}
+		}
+		if !check(current) {
+			return nil
+		}
+		if data == nil {
+			_, err = writeDB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE pk = ? AND sk = ?", tableName), pk, sk)
+		} else {
+			_, err = writeDB.ExecContext(ctx, fmt.Sprintf(`
+        	    INSERT INTO %s (pk, sk, data, expires) VALUES (?, ?, ?, ?)
+        	    ON CONFLICT(pk, sk) DO UPDATE SET data=excluded.data, expires=excluded.expires;
+        	`, tableName), pk, sk, jsonData, expiresUnix)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write row in table %s: %w", tableName, err)
+		}
+		applied = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if applied {
+		if data == nil {
+			if current != nil {
+				tm.committed(KVEvent{Type: KVEventDelete, PK: pk, SK: sk})
+			}
+		} else {
+			tm.committed(KVEvent{Type: KVEventPut, PK: pk, SK: sk, Data: data, Expires: expires})
+		}
+	}
+	return current, applied, nil
+}
+
 // Put inserts or updates a row with the given pk, sk, data, and expires.
 func (tm *KV) Put(ctx context.Context, pk string, sk string, data JSONValue, expires *time.Time) error {
 	return tm.putOrCreate(ctx, pk, sk, data, expires, true) // true allows updates
 }
 
-// Create inserts a row with the given pk, sk, data, and expires, but fails if the row already exists.
+// Create inserts a row with the given pk, sk, data, and expires, but fails with ErrKVExists if an unexpired row already exists.
 func (tm *KV) Create(ctx context.Context, pk string, sk string, data JSONValue, expires *time.Time) error {
 	return tm.putOrCreate(ctx, pk, sk, data, expires, false) // false disallows updates, failing on conflict
 }
 
+// JSONMergePatch describes a change to a JSONValue in the style of RFC 7396 JSON Merge Patch. String and float64 values are set, and nil values remove the field.
+type JSONMergePatch map[string]interface{}
+
+// MarshalJSON ensures the values are either float64, string or nil.
+func (p JSONMergePatch) MarshalJSON() ([]byte, error) {
+	temp := make(map[string]interface{})
+	for k, v := range p {
+		switch v.(type) {
+		case float64, string, nil:
+			temp[k] = v
+		default:
+			return nil, fmt.Errorf("JSONMergePatch must be a map of strings to either float64, string or nil values")
+		}
+	}
+	return json.Marshal(temp)
+}
+
+// jsonFieldPath returns the SQLite JSON path for a top level field, quoted so that field names containing dots or brackets are treated literally.
+func jsonFieldPath(field string) (string, error) {
+	if field == "" || strings.ContainsAny(field, "\"\\") {
+		return "", fmt.Errorf("invalid field name %q", field)
+	}
+	return `$."` + field + `"`, nil
+}
+
+// Increment atomically adds delta to the numeric field of the row with the given pk and sk and returns the new value of the whole row. A missing or expired row is created with the field set to delta and no expiry. A field that doesn't exist yet is treated as 0. It is an error for the field to hold a string.
+func (tm *KV) Increment(ctx context.Context, pk string, sk string, field string, delta float64) (JSONValue, error) {
+	tableName := tm.table
+	path, err := jsonFieldPath(field)
+	if err != nil {
+		return nil, err
+	}
+	now := kvNow()
+	incrementSQL := fmt.Sprintf(`
+	    INSERT INTO %s (pk, sk, data, expires) VALUES (?1, ?2, json_object(?3, ?4), NULL)
+	    ON CONFLICT(pk, sk) DO UPDATE SET
+	        data = CASE WHEN expires IS NOT NULL AND expires <= ?5 THEN excluded.data
+	               ELSE json_set(data, ?6, COALESCE(json_extract(data, ?6), 0) + ?4) END,
+	        expires = CASE WHEN expires IS NOT NULL AND expires <= ?5 THEN NULL ELSE expires END
+	    WHERE (expires IS NOT NULL AND expires <= ?5) OR json_type(data, ?6) IS NULL OR json_type(data, ?6) IN ('integer', 'real')
+	    RETURNING data, expires;
+	`, tableName)
+
+	var jsonData string
+	var expiresUnix sql.NullFloat64
+	found := false
+	err = tm.db.Write(func(writeDB WriteDBHandler) error {
+		rows, err := writeDB.QueryContext(ctx, incrementSQL, pk, sk, field, delta, now, path)
+		if err != nil {
+			return fmt.Errorf("failed to increment row in table %s: %w", tableName, err)
+		}
+		defer rows.Close()
+		if rows.Next() {
+			if err := rows.Scan(&jsonData, &expiresUnix); err != nil {
+				return fmt.Errorf("error scanning incremented row: %w", err)
+			}
+			found = true
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to increment row in table %s: %w", tableName, err)
+	}
+	if !found {
+		// The upsert's WHERE clause didn't match, so the field isn't a number. Nothing was changed.
+		return nil, fmt.Errorf("field %s of row with pk %s and sk %s is not a number", field, pk, sk)
+	}
+	return tm.publishChanged(pk, sk, jsonData, expiresUnix)
+}
+
+// Patch atomically applies a JSON Merge Patch to the row with the given pk and sk and returns the new value. The expires value is left unchanged. It is an error if the row doesn't exist or has expired.
+func (tm *KV) Patch(ctx context.Context, pk string, sk string, patch JSONMergePatch) (JSONValue, error) {
+	tableName := tm.table
+	jsonPatch, err := json.Marshal(patch)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding patch to JSON: %w", err)
+	}
+	patchSQL := fmt.Sprintf(`
+	    UPDATE %s SET data = json_patch(data, ?)
+	    WHERE pk = ? AND sk = ? AND (expires IS NULL OR expires > ?)
+	    RETURNING data, expires;
+	`, tableName)
+
+	var jsonData string
+	var expiresUnix sql.NullFloat64
+	found := false
+	err = tm.db.Write(func(writeDB WriteDBHandler) error {
+		rows, err := writeDB.QueryContext(ctx, patchSQL, string(jsonPatch), pk, sk, kvNow())
+		if err != nil {
+			return fmt.Errorf("failed to patch row in table %s: %w", tableName, err)
+		}
+		defer rows.Close()
+		if rows.Next() {
+			if err := rows.Scan(&jsonData, &expiresUnix); err != nil {
+				return fmt.Errorf("error scanning patched row: %w", err)
+			}
+			found = true
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to patch row in table %s: %w", tableName, err)
+	}
+	if !found {
+		return nil, ErrKVNotFound
+	}
+	return tm.publishChanged(pk, sk, jsonData, expiresUnix)
+}
+
+// publishChanged decodes a row returned by an update and sends a put event for it.
+func (tm *KV) publishChanged(pk, sk, jsonData string, expiresUnix sql.NullFloat64) (JSONValue, error) {
+	var data JSONValue
+	if err := json.Unmarshal([]byte(jsonData), &data); err != nil {
+		return nil, fmt.Errorf("error decoding data from JSON: %w", err)
+	}
+	expires := expiresFromDB(expiresUnix)
+	tm.committed(KVEvent{Type: KVEventPut, PK: pk, SK: sk, Data: data, Expires: expires})
+	return data, nil
+}
+
 // Get retrieves a row with the given pk and sk. It returns the data and expires if the row exists and is not expired.
 func (tm *KV) Get(ctx context.Context, pk string, sk string) (JSONValue, *time.Time, error) {
-	tableName := "kv"
+	c := tm.cache.Load()
+	if c == nil {
+		return tm.get(ctx, pk, sk)
+	}
+	data, expires, generation, ok := c.get(pk, sk)
+	if ok {
+		return data, expires, nil
+	}
+	data, expires, err := tm.get(ctx, pk, sk)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.add(generation, pk, sk, data, expires)
+	return data, expires, nil
+}
+
+// get reads a row from the database, bypassing the cache.
+func (tm *KV) get(ctx context.Context, pk string, sk string) (JSONValue, *time.Time, error) {
+	tableName := tm.table
 
 	querySQL := fmt.Sprintf(`
         SELECT data, expires FROM %s WHERE pk = ? AND sk = ? AND (expires IS NULL OR expires > ?);
     `, tableName)
 
 	var jsonData string
-	var expiresUnix sql.NullInt64
-	err := tm.db.QueryRowContext(ctx, querySQL, pk, sk, time.Now().Unix()).Scan(&jsonData, &expiresUnix)
+	var expiresUnix sql.NullFloat64
+	err := tm.db.QueryRowContext(ctx, querySQL, pk, sk, kvNow()).Scan(&jsonData, &expiresUnix)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, nil, fmt.Errorf("no matching row found")
+			return nil, nil, ErrKVNotFound
 		}
 		return nil, nil, fmt.Errorf("error querying for row: %w", err)
 	}
@@ -207,32 +455,33 @@ func (tm *KV) Get(ctx context.Context, pk string, sk string) (JSONValue, *time.T
 		return nil, nil, fmt.Errorf("error decoding data from JSON: %w", err)
 	}
 
-	var expires *time.Time
-	if expiresUnix.Valid {
-		t := time.Unix(expiresUnix.Int64, 0)
-		expires = &t
-	}
+	expires := expiresFromDB(expiresUnix)
 
 	return data, expires, nil
 }
 
 // Delete removes a row with the given pk and sk from the table.
 func (tm *KV) Delete(ctx context.Context, pk string, sk string) error {
-	tableName := "kv"
+	tableName := tm.table
 
 	// Prepare the DELETE statement
 	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE pk = ? AND sk = ?", tableName)
 
+	var deleted int64
 	err := tm.db.Write(func(writeDB WriteDBHandler) error {
-		_, err := writeDB.ExecContext(ctx, deleteSQL, pk, sk)
+		result, err := writeDB.ExecContext(ctx, deleteSQL, pk, sk)
 		if err != nil {
 			return fmt.Errorf("failed to delete row from table %s with pk %s and sk %s: %w", tableName, pk, sk, err)
 		}
-		return nil
+		deleted, err = result.RowsAffected()
+		return err
 	})
 	if err != nil {
 		return fmt.Errorf("failed to delete row from table %s with pk %s and sk %s: %w", tableName, pk, sk, err)
 	}
+	if deleted > 0 {
+		tm.committed(KVEvent{Type: KVEventDelete, PK: pk, SK: sk})
+	}
 	return err
 }
 
@@ -240,9 +489,8 @@ func (tm *KV) Delete(ctx context.Context, pk string, sk string) error {
 // If 'after' is true, search for rows with sort keys strictly greater than 'sk'.
 // Otherwise, include rows with sort keys greater than or equal to 'sk'.
 func (tm *KV) Iterate(ctx context.Context, pk, sk string, limit int, after bool) ([]Row, string, error) {
-	tableName := "kv"
+	tableName := tm.table
 
-	var rows []Row
 	var querySQL string
 	var args []interface{}
 
@@ -257,47 +505,208 @@ func (tm *KV) Iterate(ctx context.Context, pk, sk string, limit int, after bool)
             WHERE pk = ? AND sk %s ? AND (expires IS NULL OR expires > ?)
             ORDER BY sk ASC
             LIMIT ?;`, tableName, skCondition)
-		args = []interface{}{pk, sk, time.Now().Unix(), limit}
+		args = []interface{}{pk, sk, kvNow(), limit}
 	} else {
 		querySQL = fmt.Sprintf(`
             SELECT pk, sk, data, expires FROM %s
             WHERE pk = ? AND (expires IS NULL OR expires > ?)
             ORDER BY sk ASC
             LIMIT ?;`, tableName)
-		args = []interface{}{pk, time.Now().Unix(), limit}
+		args = []interface{}{pk, kvNow(), limit}
 	}
 
+	rows, err := tm.queryRows(ctx, querySQL, args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Generate a new 'after' token for pagination, based on the last 'sk' value seen
+	newAfter := sk
+	if len(rows) > 0 {
+		newAfter = rows[len(rows)-1].SK
+	}
+
+	return rows, newAfter, nil
+}
+
+// queryRows runs a SELECT returning pk, sk, data and expires columns and decodes the results.
+func (tm *KV) queryRows(ctx context.Context, querySQL string, args ...interface{}) ([]Row, error) {
 	sqlRows, err := tm.db.QueryContext(ctx, querySQL, args...)
 	if err != nil {
-		return nil, "", fmt.Errorf("error executing iterate query: %w", err)
+		return nil, fmt.Errorf("error executing iterate query: %w", err)
 	}
 	defer sqlRows.Close()
 
+	var rows []Row
 	for sqlRows.Next() {
-		var r Row
-		var expiresUnix sql.NullInt64
-		var jsonData string
-		if err := sqlRows.Scan(&r.PK, &r.SK, &jsonData, &expiresUnix); err != nil {
-			return nil, "", fmt.Errorf("error scanning row: %w", err)
+		r, err := scanRow(sqlRows)
+		if err != nil {
+			return nil, err
 		}
+		rows = append(rows, r)
+	}
+	if err := sqlRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return rows, nil
+}
+
+// scanRow decodes the pk, sk, data and expires columns of the current row.
+func scanRow(sqlRows *sql.Rows) (Row, error) {
+	var r Row
+	var expiresUnix sql.NullFloat64
+	var jsonData string
+	if err := sqlRows.Scan(&r.PK, &r.SK, &jsonData, &expiresUnix); err != nil {
+		return r, fmt.Errorf("error scanning row: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(jsonData), &r.Data); err != nil {
+		return r, fmt.Errorf("error unmarshaling JSON data: %w", err)
+	}
+
+	r.Expires = expiresFromDB(expiresUnix)
+	return r, nil
+}
+
+// ErrInvalidCursor is returned by Query when a cursor has been tampered with, was issued by a different KV, or doesn't match the query it is used with.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// KVCursor is an opaque pagination token returned by Query. It records the partition, the direction and the last sort key returned, and is signed so that it can't be altered by clients.
+type KVCursor string
+
+// KVQuery describes a range query over the rows of a single partition. All the conditions are combined, so for example BeginsWith and End can be used together.
+type KVQuery struct {
+	// BeginsWith restricts the results to sort keys starting with this prefix.
+	BeginsWith string
+	// Start is an inclusive lower bound on the sort key. Leave empty for no bound.
+	Start string
+	// End is an inclusive upper bound on the sort key. Leave empty for no bound.
+	End string
+	// Reverse returns rows in descending sort key order, which is useful for "latest N" pages over time-ordered sort keys.
+	Reverse bool
+	// Limit is the maximum number of rows to return. Zero or less means no limit.
+	Limit int
+	// Cursor continues from the position recorded by an earlier Query with the same direction.
+	Cursor KVCursor
+}
+
+type kvCursor struct {
+	Table   string `json:"t"`
+	PK      string `json:"p"`
+	SK      string `json:"s"`
+	Reverse bool   `json:"r,omitempty"`
+}
+
+// SetCursorSecret sets the key used to sign cursors. By default a random key is generated by NewKV, which means cursors stop working when the process restarts. Set the same secret in every process that should accept each other's cursors. Cursors signed with the previous secret are rejected with ErrInvalidCursor once it has been changed. It is safe to call while Query is running.
+func (tm *KV) SetCursorSecret(secret string) {
+	tm.cursorSecret.Store(&secret)
+}
+
+func encodeCursor(secret string, c kvCursor) (KVCursor, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("error encoding cursor: %w", err)
+	}
+	return KVCursor(base64.RawURLEncoding.EncodeToString(payload) + "." + hashContentWithSalt(payload, secret)), nil
+}
 
-		if err := json.Unmarshal([]byte(jsonData), &r.Data); err != nil {
-			return nil, "", fmt.Errorf("error unmarshaling JSON data: %w", err)
+func decodeCursor(secret string, cursor KVCursor) (kvCursor, error) {
+	var c kvCursor
+	encoded, signature, found := strings.Cut(string(cursor), ".")
+	if !found {
+		return c, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if !hmac.Equal([]byte(signature), []byte(hashContentWithSalt(payload, secret))) {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// prefixUpperBound returns the smallest string greater than every string starting with prefix, or false if there isn't one. SQLite compares TEXT with memcmp() by default so this works byte-wise.
+func prefixUpperBound(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
 		}
+	}
+	return "", false
+}
 
-		if expiresUnix.Valid {
-			expires := time.Unix(expiresUnix.Int64, 0)
-			r.Expires = &expires
+// Query returns the unexpired rows in partition pk matching q, together with a cursor for the next page. The cursor is empty when there are no more rows.
+func (tm *KV) Query(ctx context.Context, pk string, q KVQuery) ([]Row, KVCursor, error) {
+	tableName := tm.table
+
+	conditions := []string{"pk = ?", "(expires IS NULL OR expires > ?)"}
+	args := []interface{}{pk, kvNow()}
+	if q.BeginsWith != "" {
+		conditions = append(conditions, "sk >= ?")
+		args = append(args, q.BeginsWith)
+		if upper, ok := prefixUpperBound(q.BeginsWith); ok {
+			conditions = append(conditions, "sk < ?")
+			args = append(args, upper)
 		}
+	}
+	if q.Start != "" {
+		conditions = append(conditions, "sk >= ?")
+		args = append(args, q.Start)
+	}
+	if q.End != "" {
+		conditions = append(conditions, "sk <= ?")
+		args = append(args, q.End)
+	}
+	if q.Cursor != "" {
+		c, err := decodeCursor(*tm.cursorSecret.Load(), q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if c.Table != tm.table || c.PK != pk || c.Reverse != q.Reverse {
+			return nil, "", ErrInvalidCursor
+		}
+		if q.Reverse {
+			conditions = append(conditions, "sk < ?")
+		} else {
+			conditions = append(conditions, "sk > ?")
+		}
+		args = append(args, c.SK)
+	}
 
-		rows = append(rows, r)
+	order := "ASC"
+	if q.Reverse {
+		order = "DESC"
+	}
+	// Fetch one extra row so we know whether there is another page
+	limit := -1
+	if q.Limit > 0 {
+		limit = q.Limit + 1
 	}
+	args = append(args, limit)
 
-	// Generate a new 'after' token for pagination, based on the last 'sk' value seen
-	newAfter := sk
-	if len(rows) > 0 {
-		newAfter = rows[len(rows)-1].SK
+	querySQL := fmt.Sprintf(`
+            SELECT pk, sk, data, expires FROM %s
+            WHERE %s
+            ORDER BY sk %s
+            LIMIT ?;`, tableName, strings.Join(conditions, " AND "), order)
+	rows, err := tm.queryRows(ctx, querySQL, args...)
+	if err != nil {
+		return nil, "", err
 	}
 
-	return rows, newAfter, nil
+	var next KVCursor
+	if q.Limit > 0 && len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+		next, err = encodeCursor(*tm.cursorSecret.Load(), kvCursor{Table: tm.table, PK: pk, SK: rows[len(rows)-1].SK, Reverse: q.Reverse})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return rows, next, nil
 }
@@ -6,6 +6,7 @@ package greener_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -361,6 +362,161 @@ func TestKVStore(t *testing.T) {
 		wg.Wait() // Wait for all goroutines to finish
 	})
 
+	t.Run("10. Query with prefixes, bounds, reverse order and cursors", func(t *testing.T) {
+		t.Parallel()
+		pk := "test/events"
+		for _, sk := range []string{"2024-01-01", "2024-01-02", "2024-02-01", "2024-02-02", "2024-03-01"} {
+			if err := tm.Put(ctx, pk, sk, greener.JSONValue{"day": sk}, nil); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		sks := func(rows []greener.Row) []string {
+			result := []string{}
+			for _, row := range rows {
+				result = append(result, row.SK)
+			}
+			return result
+		}
+
+		rows, cursor, err := tm.Query(ctx, pk, greener.KVQuery{BeginsWith: "2024-02"})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if got, want := sks(rows), []string{"2024-02-01", "2024-02-02"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("BeginsWith returned %v, expected %v", got, want)
+		}
+		if cursor != "" {
+			t.Fatalf("Expected no cursor without a limit, got %q", cursor)
+		}
+
+		rows, _, err = tm.Query(ctx, pk, greener.KVQuery{Start: "2024-01-02", End: "2024-02-02", Reverse: true})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if got, want := sks(rows), []string{"2024-02-02", "2024-02-01", "2024-01-02"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Reverse between returned %v, expected %v", got, want)
+		}
+
+		// Page backwards through the partition two rows at a time
+		var pages [][]string
+		cursor = ""
+		for {
+			rows, cursor, err = tm.Query(ctx, pk, greener.KVQuery{Reverse: true, Limit: 2, Cursor: cursor})
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			pages = append(pages, sks(rows))
+			if cursor == "" {
+				break
+			}
+		}
+		expectedPages := [][]string{{"2024-03-01", "2024-02-02"}, {"2024-02-01", "2024-01-02"}, {"2024-01-01"}}
+		if !reflect.DeepEqual(pages, expectedPages) {
+			t.Fatalf("Reverse pages were %v, expected %v", pages, expectedPages)
+		}
+
+		_, cursor, err = tm.Query(ctx, pk, greener.KVQuery{Limit: 1})
+		if err != nil || cursor == "" {
+			t.Fatalf("Expected a cursor, got %q, %v", cursor, err)
+		}
+		if _, _, err = tm.Query(ctx, pk, greener.KVQuery{Limit: 1, Cursor: cursor, Reverse: true}); !errors.Is(err, greener.ErrInvalidCursor) {
+			t.Fatalf("Expected a cursor direction mismatch to be rejected, got %v", err)
+		}
+		if _, _, err = tm.Query(ctx, "test/other", greener.KVQuery{Limit: 1, Cursor: cursor}); !errors.Is(err, greener.ErrInvalidCursor) {
+			t.Fatalf("Expected a cursor for a different pk to be rejected, got %v", err)
+		}
+		if _, _, err = tm.Query(ctx, pk, greener.KVQuery{Limit: 1, Cursor: cursor[1:]}); !errors.Is(err, greener.ErrInvalidCursor) {
+			t.Fatalf("Expected a tampered cursor to be rejected, got %v", err)
+		}
+
+		// Changing the secret while queries run must be safe, and invalidates old cursors
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tm.Query(ctx, pk, greener.KVQuery{Limit: 1})
+			}()
+		}
+		tm.SetCursorSecret("shared secret")
+		wg.Wait()
+		if _, _, err = tm.Query(ctx, pk, greener.KVQuery{Limit: 1, Cursor: cursor}); !errors.Is(err, greener.ErrInvalidCursor) {
+			t.Fatalf("Expected a cursor signed with the old secret to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("11. Increment and Patch atomically", func(t *testing.T) {
+		t.Parallel()
+		pk := "test/counters"
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(Fatalf func(format string, args ...interface{})) {
+				defer wg.Done()
+				if _, err := tm.Increment(ctx, pk, "hits", "count", 1); err != nil {
+					Fatalf("Increment failed: %v", err)
+				}
+			}(t.Fatalf)
+		}
+		wg.Wait()
+		data, _, err := tm.Get(ctx, pk, "hits")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if data["count"] != 100.0 {
+			t.Fatalf("Expected count of 100, got %v", data["count"])
+		}
+
+		if err := tm.Put(ctx, pk, "profile", greener.JSONValue{"name": "Ann", "city": "Leeds", "visits": 1.0}, nil); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if _, err := tm.Increment(ctx, pk, "profile", "name", 1); err == nil {
+			t.Fatalf("Expected incrementing a string field to fail")
+		}
+		data, err = tm.Increment(ctx, pk, "profile", "visits", 2.5)
+		if err != nil {
+			t.Fatalf("Increment failed: %v", err)
+		}
+		if data["visits"] != 3.5 || data["name"] != "Ann" {
+			t.Fatalf("Unexpected data after increment: %v", data)
+		}
+
+		data, err = tm.Patch(ctx, pk, "profile", greener.JSONMergePatch{"city": nil, "name": "Bob"})
+		if err != nil {
+			t.Fatalf("Patch failed: %v", err)
+		}
+		expected := greener.JSONValue{"name": "Bob", "visits": 3.5}
+		if !reflect.DeepEqual(data, expected) {
+			t.Fatalf("Patch returned %v, expected %v", data, expected)
+		}
+		if _, err := tm.Patch(ctx, pk, "missing", greener.JSONMergePatch{"name": "Bob"}); err == nil {
+			t.Fatalf("Expected patching a missing row to fail")
+		}
+	})
+
+	t.Run("12. Named tables are isolated from each other", func(t *testing.T) {
+		t.Parallel()
+		sessions, err := greener.NewKVTable(ctx, db, "sessions")
+		if err != nil {
+			t.Fatalf("NewKVTable failed: %v", err)
+		}
+		if err := sessions.Put(ctx, "example/table/1", "isolated", greener.JSONValue{"table": "sessions"}, nil); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if _, _, err := tm.Get(ctx, "example/table/1", "isolated"); err == nil {
+			t.Fatalf("A row put in the sessions table was visible in the default table")
+		}
+		data, _, err := sessions.Get(ctx, "example/table/1", "isolated")
+		if err != nil || data["table"] != "sessions" {
+			t.Fatalf("Get from the sessions table failed: %v %v", data, err)
+		}
+		for _, name := range []string{"", "1kv", "kv; DROP TABLE kv", "kv-store", "sqlite_master", "\"kv\""} {
+			if _, err := greener.NewKVTable(ctx, db, name); err == nil {
+				t.Fatalf("Expected table name %q to be rejected", name)
+			}
+		}
+	})
+
 	// Finally check table loading:
 
 	// // Load another KV instance
@@ -0,0 +1,124 @@
+package greener
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KVCacheStats reports how well the cache enabled by EnableCache is working.
+type KVCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+type kvCacheKey struct {
+	pk string
+	sk string
+}
+
+type kvCacheEntry struct {
+	key     kvCacheKey
+	data    JSONValue
+	expires *time.Time
+}
+
+// kvCache is a bounded LRU cache of rows. A global generation number, bumped on every invalidation, stops a Get that read the database before a write committed from caching the value it read after the write's invalidation has run.
+type kvCache struct {
+	mu         sync.Mutex
+	capacity   int
+	order      *list.List
+	entries    map[kvCacheKey]*list.Element
+	generation uint64
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+}
+
+func newKVCache(capacity int) *kvCache {
+	return &kvCache{capacity: capacity, order: list.New(), entries: make(map[kvCacheKey]*list.Element)}
+}
+
+// get returns a cached row if there is one that hasn't expired, along with the generation to pass to add on a miss.
+func (c *kvCache) get(pk, sk string) (JSONValue, *time.Time, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[kvCacheKey{pk, sk}]; ok {
+		entry := element.Value.(*kvCacheEntry)
+		if entry.expires == nil || entry.expires.After(time.Now()) {
+			c.order.MoveToFront(element)
+			c.hits.Add(1)
+			return copyJSONValue(entry.data), entry.expires, c.generation, true
+		}
+		c.order.Remove(element)
+		delete(c.entries, entry.key)
+	}
+	c.misses.Add(1)
+	return nil, nil, c.generation, false
+}
+
+// add caches a row read from the database, unless a write has committed since generation was returned by get.
+func (c *kvCache) add(generation uint64, pk, sk string, data JSONValue, expires *time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	key := kvCacheKey{pk, sk}
+	entry := &kvCacheEntry{key: key, data: copyJSONValue(data), expires: expires}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*kvCacheEntry).key)
+	}
+}
+
+// invalidate drops the rows changed by a committed write.
+func (c *kvCache) invalidate(events []KVEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, event := range events {
+		key := kvCacheKey{event.PK, event.SK}
+		if element, ok := c.entries[key]; ok {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// EnableCache puts a read-through LRU cache holding up to size rows in front of Get. Rows are dropped from the cache once the write that changes them has committed, and expired rows are never returned, so Get behaves just as it does without the cache. Changes made to the table by anything other than this KV, such as another process sharing the database file, are not seen until the row is evicted, so only enable the cache when this KV is the only writer. A size of zero or less disables the cache.
+func (tm *KV) EnableCache(size int) {
+	if size <= 0 {
+		tm.cache.Store(nil)
+		return
+	}
+	tm.cache.Store(newKVCache(size))
+}
+
+// CacheStats returns the cache's hit and miss counters, which are reset by EnableCache.
+func (tm *KV) CacheStats() KVCacheStats {
+	c := tm.cache.Load()
+	if c == nil {
+		return KVCacheStats{}
+	}
+	c.mu.Lock()
+	entries := c.order.Len()
+	c.mu.Unlock()
+	return KVCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Entries: entries}
+}
+
+// committed is called with the changes made by every write once it has committed. It invalidates cached rows and then notifies watchers.
+func (tm *KV) committed(events ...KVEvent) {
+	if c := tm.cache.Load(); c != nil {
+		c.invalidate(events)
+	}
+	tm.watchers.publish(events...)
+}
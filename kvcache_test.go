@@ -0,0 +1,122 @@
+package greener_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestKVCache(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	db := newTestBatchDB(t, "kvcache")
+	kv, err := greener.NewKV(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.EnableCache(2)
+
+	get := func(pk, sk string) greener.JSONValue {
+		t.Helper()
+		data, _, err := kv.Get(ctx, pk, sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	t.Run("Hits, misses and invalidation", func(t *testing.T) {
+		if err := kv.Put(ctx, "c", "a", greener.JSONValue{"n": 1.0}, nil); err != nil {
+			t.Fatal(err)
+		}
+		get("c", "a")
+		data := get("c", "a")
+		data["n"] = 100.0
+		if stats := kv.CacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+			t.Fatalf("Unexpected stats %+v", stats)
+		}
+		if get("c", "a")["n"] != 1.0 {
+			t.Fatalf("Changing a returned value changed the cache")
+		}
+		if _, err := kv.Increment(ctx, "c", "a", "n", 1); err != nil {
+			t.Fatal(err)
+		}
+		if n := get("c", "a")["n"]; n != 2.0 {
+			t.Fatalf("Expected Increment to invalidate the cache, got %v", n)
+		}
+		if _, err := kv.Patch(ctx, "c", "a", greener.JSONMergePatch{"n": 3.0}); err != nil {
+			t.Fatal(err)
+		}
+		if n := get("c", "a")["n"]; n != 3.0 {
+			t.Fatalf("Expected Patch to invalidate the cache, got %v", n)
+		}
+		if err := kv.Delete(ctx, "c", "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := kv.Get(ctx, "c", "a"); err == nil {
+			t.Fatalf("Expected Delete to invalidate the cache")
+		}
+	})
+
+	t.Run("Expiry and eviction", func(t *testing.T) {
+		soon := time.Now().Add(30 * time.Millisecond)
+		if err := kv.Put(ctx, "e", "soon", greener.JSONValue{}, &soon); err != nil {
+			t.Fatal(err)
+		}
+		get("e", "soon")
+		time.Sleep(40 * time.Millisecond)
+		if _, _, err := kv.Get(ctx, "e", "soon"); err == nil {
+			t.Fatalf("Expected the cached row to expire")
+		}
+		for _, sk := range []string{"1", "2", "3"} {
+			if err := kv.Put(ctx, "e", sk, greener.JSONValue{}, nil); err != nil {
+				t.Fatal(err)
+			}
+			get("e", sk)
+		}
+		if stats := kv.CacheStats(); stats.Entries != 2 {
+			t.Fatalf("Expected the cache to be bounded, got %+v", stats)
+		}
+	})
+
+	t.Run("Concurrent writers in the same batch", func(t *testing.T) {
+		uncached, err := greener.NewKV(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < 10; w++ {
+			wg.Add(2)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					if err := kv.Put(ctx, "race", fmt.Sprint(w%3), greener.JSONValue{"v": float64(w*100 + i)}, nil); err != nil {
+						t.Errorf("Put failed: %v", err)
+					}
+				}
+			}(w)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					kv.Get(ctx, "race", fmt.Sprint(w%3))
+				}
+			}(w)
+		}
+		wg.Wait()
+		for _, sk := range []string{"0", "1", "2"} {
+			cached := get("race", sk)
+			stored, _, err := uncached.Get(ctx, "race", sk)
+			if err != nil || cached["v"] != stored["v"] {
+				t.Fatalf("Cache for %s is stale: %v, database has %v %v", sk, cached, stored, err)
+			}
+		}
+	})
+}
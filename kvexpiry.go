@@ -0,0 +1,140 @@
+package greener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Expiry times are stored in the expires column as seconds since the epoch. Whole seconds are stored as integers, just as they always have been, and anything more precise is stored as a real number with millisecond precision, so existing databases keep working.
+
+// expiresToDB converts an expiry time to the value stored in the expires column, or nil for no expiry.
+func expiresToDB(expires *time.Time) *float64 {
+	if expires == nil {
+		return nil
+	}
+	seconds := float64(expires.UnixMilli()) / 1000
+	return &seconds
+}
+
+// expiresFromDB converts a value from the expires column back to a time, rounding to the nearest millisecond.
+func expiresFromDB(expires sql.NullFloat64) *time.Time {
+	if !expires.Valid {
+		return nil
+	}
+	t := time.UnixMilli(int64(math.Round(expires.Float64 * 1000)))
+	return &t
+}
+
+// kvNow returns the current time in the format of the expires column.
+func kvNow() float64 {
+	return float64(time.Now().UnixMilli()) / 1000
+}
+
+// KVExpiryOptions configures the expiry engine started by StartExpiry.
+type KVExpiryOptions struct {
+	// Interval is how often to look for expired rows. Defaults to 60 seconds.
+	Interval time.Duration
+	// BatchSize is the maximum number of rows deleted in each write, so that a large backlog doesn't hold up other writers in one huge transaction. Defaults to 1000.
+	BatchSize int
+	// OnExpire, if set, is called with the rows removed by each batch once the deletion has been committed, so that related data can be cleaned up. Expired rows are also sent to watchers as KVEventExpire events.
+	OnExpire func([]Row)
+	// Logger receives errors from the background routine. Defaults to the standard library log package.
+	Logger Logger
+}
+
+func (o KVExpiryOptions) withDefaults() KVExpiryOptions {
+	if o.Interval <= 0 {
+		o.Interval = 60 * time.Second
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 1000
+	}
+	if o.Logger == nil {
+		o.Logger = NewDefaultLogger(log.Printf)
+	}
+	return o
+}
+
+// StartExpiry runs a goroutine that deletes expired rows every opts.Interval until ctx is done.
+func (tm *KV) StartExpiry(ctx context.Context, opts KVExpiryOptions) {
+	opts = opts.withDefaults()
+	go func() {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := tm.DeleteExpired(ctx, opts); err != nil && ctx.Err() == nil {
+					opts.Logger.Logf("Error cleaning up expired rows in table %s: %v", tm.table, err)
+				}
+			}
+		}
+	}()
+}
+
+// DeleteExpired removes all the rows that have expired, in batches of opts.BatchSize, and returns how many were removed. Each batch is committed before OnExpire is called and the expire events are sent. If history is enabled, old versions are then pruned according to the history policy. The Interval option is ignored.
+func (tm *KV) DeleteExpired(ctx context.Context, opts KVExpiryOptions) (int, error) {
+	opts = opts.withDefaults()
+	tableName := tm.table
+	deleteSQL := fmt.Sprintf(`
+	    DELETE FROM %s WHERE rowid IN (
+	        SELECT rowid FROM %s WHERE expires IS NOT NULL AND expires <= ? LIMIT ?
+	    ) RETURNING pk, sk, data, expires;
+	`, tableName, tableName)
+	total := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		var expired []Row
+		err := tm.db.Write(func(writeDB WriteDBHandler) error {
+			expired = expired[:0]
+			rows, err := writeDB.QueryContext(ctx, deleteSQL, kvNow(), opts.BatchSize)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var r Row
+				var jsonData string
+				var expiresUnix sql.NullFloat64
+				if err := rows.Scan(&r.PK, &r.SK, &jsonData, &expiresUnix); err != nil {
+					return err
+				}
+				// Undecodable data is still deleted, it just isn't passed on
+				json.Unmarshal([]byte(jsonData), &r.Data)
+				r.Expires = expiresFromDB(expiresUnix)
+				expired = append(expired, r)
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return total, fmt.Errorf("failed to delete expired rows from table %s: %w", tableName, err)
+		}
+		total += len(expired)
+		if len(expired) > 0 {
+			events := make([]KVEvent, len(expired))
+			for i, r := range expired {
+				events[i] = KVEvent{Type: KVEventExpire, PK: r.PK, SK: r.SK, Data: r.Data, Expires: r.Expires}
+			}
+			tm.committed(events...)
+			if opts.OnExpire != nil {
+				opts.OnExpire(expired)
+			}
+		}
+		if len(expired) < opts.BatchSize {
+			break
+		}
+	}
+	if _, err := tm.pruneHistory(ctx, opts.BatchSize); err != nil {
+		return total, err
+	}
+	return total, nil
+}
@@ -0,0 +1,126 @@
+package greener_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestKVExpiry(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	kv, err := greener.NewKV(ctx, newTestBatchDB(t, "kvexpiry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Millisecond precision", func(t *testing.T) {
+		expires := time.Now().Add(150 * time.Millisecond).Truncate(time.Millisecond)
+		if err := kv.Put(ctx, "ms", "row", greener.JSONValue{"n": 1.0}, &expires); err != nil {
+			t.Fatal(err)
+		}
+		_, retrievedExpires, err := kv.Get(ctx, "ms", "row")
+		if err != nil {
+			t.Fatalf("Row expired too early: %v", err)
+		}
+		if !retrievedExpires.Equal(expires) {
+			t.Fatalf("Expected expires of %v, got %v", expires, *retrievedExpires)
+		}
+		time.Sleep(time.Until(expires) + 10*time.Millisecond)
+		if _, _, err := kv.Get(ctx, "ms", "row"); err == nil {
+			t.Fatalf("Row should have expired")
+		}
+	})
+
+	t.Run("DeleteExpired works in batches and reports the rows", func(t *testing.T) {
+		past := time.Now().Add(-time.Second)
+		for i := 0; i < 25; i++ {
+			if err := kv.Put(ctx, "batch", fmt.Sprintf("row%02d", i), greener.JSONValue{"i": float64(i)}, &past); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := kv.Put(ctx, "batch", "forever", greener.JSONValue{"i": -1.0}, nil); err != nil {
+			t.Fatal(err)
+		}
+		var batches []int
+		seen := map[string]bool{}
+		count, err := kv.DeleteExpired(ctx, greener.KVExpiryOptions{
+			BatchSize: 10,
+			OnExpire: func(rows []greener.Row) {
+				batches = append(batches, len(rows))
+				for _, row := range rows {
+					seen[row.SK] = row.Data != nil
+				}
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The "ms" row from the previous test may also be removed here
+		if count < 25 || len(batches) < 3 || batches[0] != 10 {
+			t.Fatalf("Unexpected deletion of %d rows in batches %v", count, batches)
+		}
+		for i := 0; i < 25; i++ {
+			if !seen[fmt.Sprintf("row%02d", i)] {
+				t.Fatalf("Row %d was not reported with its data", i)
+			}
+		}
+		if _, _, err := kv.Get(ctx, "batch", "forever"); err != nil {
+			t.Fatalf("A row without an expiry was deleted: %v", err)
+		}
+	})
+
+	t.Run("StartExpiry runs until the context is cancelled", func(t *testing.T) {
+		expiryCtx, stop := context.WithCancel(ctx)
+		var mu sync.Mutex
+		expired := map[string]bool{}
+		kv.StartExpiry(expiryCtx, greener.KVExpiryOptions{
+			Interval: 10 * time.Millisecond,
+			OnExpire: func(rows []greener.Row) {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, row := range rows {
+					expired[row.PK+"/"+row.SK] = true
+				}
+			},
+		})
+		soon := time.Now().Add(20 * time.Millisecond)
+		if err := kv.Put(ctx, "engine", "first", greener.JSONValue{"n": 1.0}, &soon); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			mu.Lock()
+			done := expired["engine/first"]
+			mu.Unlock()
+			if done {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("The expiry engine didn't remove the expired row")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		stop()
+		time.Sleep(20 * time.Millisecond)
+		past := time.Now().Add(-time.Second)
+		if err := kv.Put(ctx, "engine", "second", greener.JSONValue{"n": 2.0}, &past); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		if expired["engine/second"] {
+			t.Fatalf("The expiry engine kept running after its context was cancelled")
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package greener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// KVHistoryPolicy controls how many previous versions EnableHistory keeps. Both limits are enforced by DeleteExpired, and so by the routine started with StartExpiry or StartCleanupRoutine.
+type KVHistoryPolicy struct {
+	// KeepVersions is the number of versions kept for each row, including the current one. Zero keeps every version.
+	KeepVersions int
+	// MaxAge removes versions written longer ago than this, apart from the latest version of each row. Zero keeps versions forever.
+	MaxAge time.Duration
+}
+
+// KVVersion is one entry in the history of a row.
+type KVVersion struct {
+	Data    JSONValue
+	Expires *time.Time
+	// Written is when the statement that stored this version ran, according to SQLite's clock. Writes are batched, so this can be a little before the version was committed and became visible to Get, and GetAsOf uses it to decide which version was current at a given time.
+	Written time.Time
+	// Deleted is true if this version records the row being deleted or expired, in which case Data is nil.
+	Deleted bool
+}
+
+// sqliteNow is an SQL expression for the current time in seconds since the epoch, with millisecond precision, which is the same format kvNow() uses.
+const sqliteNow = "((julianday('now') - 2440587.5) * 86400.0)"
+
+// historyTable returns the name of the KV's history table. KV table names must start with a letter, so no KV can have the same name.
+func (tm *KV) historyTable() string {
+	return "_history_" + tm.table
+}
+
+// EnableHistory creates a history table for the KV, called _history_ followed by the KV's table name, along with triggers that record every insert, update and delete in it. Because the triggers run inside SQLite, the history is written in the same transaction as the change, whichever KV method made it. The triggers stay in place until DisableHistory is called, but EnableHistory should be called each time the KV is created so that the retention policy is known.
+func (tm *KV) EnableHistory(ctx context.Context, policy KVHistoryPolicy) error {
+	tableName := tm.table
+	historyTable := tm.historyTable()
+	queries := []string{
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+		    id INTEGER PRIMARY KEY AUTOINCREMENT,
+		    pk TEXT NOT NULL,
+		    sk TEXT NOT NULL,
+		    data JSON,
+		    expires INTEGER,
+		    written REAL NOT NULL,
+		    deleted INTEGER NOT NULL DEFAULT 0
+		);`, historyTable),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_key ON %s (pk, sk, id);`, historyTable, historyTable),
+		fmt.Sprintf(`
+		CREATE TRIGGER IF NOT EXISTS %s_insert AFTER INSERT ON %s BEGIN
+		    INSERT INTO %s (pk, sk, data, expires, written) VALUES (NEW.pk, NEW.sk, NEW.data, NEW.expires, %s);
+		END;`, historyTable, tableName, historyTable, sqliteNow),
+		fmt.Sprintf(`
+		CREATE TRIGGER IF NOT EXISTS %s_update AFTER UPDATE ON %s BEGIN
+		    INSERT INTO %s (pk, sk, data, expires, written) VALUES (NEW.pk, NEW.sk, NEW.data, NEW.expires, %s);
+		END;`, historyTable, tableName, historyTable, sqliteNow),
+		fmt.Sprintf(`
+		CREATE TRIGGER IF NOT EXISTS %s_delete AFTER DELETE ON %s BEGIN
+		    INSERT INTO %s (pk, sk, data, expires, written, deleted) VALUES (OLD.pk, OLD.sk, NULL, NULL, %s, 1);
+		END;`, historyTable, tableName, historyTable, sqliteNow),
+	}
+	err := tm.db.Write(func(writeDB WriteDBHandler) error {
+		for _, query := range queries {
+			if _, err := writeDB.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("failed to set up history for table %s: %w", tableName, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tm.historyPolicy.Store(&policy)
+	// The new policy may keep fewer versions, so every row needs checking again
+	tm.historyPrunedID.Store(0)
+	return nil
+}
+
+// DisableHistory drops the triggers that record history. The history table itself is kept, so GetAsOf and History still return the versions recorded so far.
+func (tm *KV) DisableHistory(ctx context.Context) error {
+	historyTable := tm.historyTable()
+	err := tm.db.Write(func(writeDB WriteDBHandler) error {
+		for _, trigger := range []string{"insert", "update", "delete"} {
+			if _, err := writeDB.ExecContext(ctx, fmt.Sprintf("DROP TRIGGER IF EXISTS %s_%s;", historyTable, trigger)); err != nil {
+				return fmt.Errorf("failed to drop history trigger: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tm.historyPolicy.Store(nil)
+	return nil
+}
+
+func scanVersion(sqlRows *sql.Rows) (KVVersion, error) {
+	var v KVVersion
+	var jsonData sql.NullString
+	var expiresUnix sql.NullFloat64
+	var written float64
+	if err := sqlRows.Scan(&jsonData, &expiresUnix, &written, &v.Deleted); err != nil {
+		return v, fmt.Errorf("error scanning history row: %w", err)
+	}
+	if jsonData.Valid {
+		if err := json.Unmarshal([]byte(jsonData.String), &v.Data); err != nil {
+			return v, fmt.Errorf("error decoding data from JSON: %w", err)
+		}
+	}
+	v.Expires = expiresFromDB(expiresUnix)
+	v.Written = time.UnixMilli(int64(math.Round(written * 1000)))
+	return v, nil
+}
+
+// History returns up to limit versions of the row with the given pk and sk, newest first. A limit of zero or less returns every version.
+func (tm *KV) History(ctx context.Context, pk string, sk string, limit int) ([]KVVersion, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	querySQL := fmt.Sprintf(`
+	    SELECT data, expires, written, deleted FROM %s
+	    WHERE pk = ? AND sk = ?
+	    ORDER BY id DESC
+	    LIMIT ?;`, tm.historyTable())
+	sqlRows, err := tm.db.QueryContext(ctx, querySQL, pk, sk, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying history: %w", err)
+	}
+	defer sqlRows.Close()
+	var versions []KVVersion
+	for sqlRows.Next() {
+		v, err := scanVersion(sqlRows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	if err := sqlRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating history: %w", err)
+	}
+	return versions, nil
+}
+
+// GetAsOf returns the data and expires the row with the given pk and sk had at time t, in the same way Get does for the present. It returns ErrKVNotFound if the row didn't exist, had been deleted or had expired at that time, or if the version has been removed by the retention policy.
+func (tm *KV) GetAsOf(ctx context.Context, pk string, sk string, t time.Time) (JSONValue, *time.Time, error) {
+	querySQL := fmt.Sprintf(`
+	    SELECT data, expires, written, deleted FROM %s
+	    WHERE pk = ? AND sk = ? AND written <= ?
+	    ORDER BY id DESC
+	    LIMIT 1;`, tm.historyTable())
+	sqlRows, err := tm.db.QueryContext(ctx, querySQL, pk, sk, float64(t.UnixMilli())/1000)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error querying history: %w", err)
+	}
+	defer sqlRows.Close()
+	if !sqlRows.Next() {
+		if err := sqlRows.Err(); err != nil {
+			return nil, nil, fmt.Errorf("error querying history: %w", err)
+		}
+		return nil, nil, ErrKVNotFound
+	}
+	v, err := scanVersion(sqlRows)
+	if err != nil {
+		return nil, nil, err
+	}
+	if v.Deleted || (v.Expires != nil && !v.Expires.After(t)) {
+		return nil, nil, ErrKVNotFound
+	}
+	return v.Data, v.Expires, nil
+}
+
+// pruneHistory applies the retention policy set by EnableHistory, deleting at most batchSize versions per write. KeepVersions is only checked for the rows with versions recorded since the last prune, since no other row can have gained any.
+func (tm *KV) pruneHistory(ctx context.Context, batchSize int) (int, error) {
+	policy := tm.historyPolicy.Load()
+	if policy == nil {
+		return 0, nil
+	}
+	historyTable := tm.historyTable()
+	var latestID int64
+	if err := tm.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(MAX(id), 0) FROM %s", historyTable)).Scan(&latestID); err != nil {
+		return 0, fmt.Errorf("failed to read history table %s: %w", historyTable, err)
+	}
+	prunedID := tm.historyPrunedID.Load()
+	var queries []string
+	var args [][]interface{}
+	if policy.KeepVersions > 0 && latestID > prunedID {
+		queries = append(queries, fmt.Sprintf(`
+		    DELETE FROM %s WHERE id IN (
+		        SELECT id FROM (
+		            SELECT id, ROW_NUMBER() OVER (PARTITION BY pk, sk ORDER BY id DESC) AS n FROM %s
+		            WHERE (pk, sk) IN (SELECT pk, sk FROM %s WHERE id > ?)
+		        ) WHERE n > ? LIMIT ?
+		    );`, historyTable, historyTable, historyTable))
+		args = append(args, []interface{}{prunedID, policy.KeepVersions, batchSize})
+	}
+	if policy.MaxAge > 0 {
+		cutoff := float64(time.Now().Add(-policy.MaxAge).UnixMilli()) / 1000
+		// Old versions go, except the latest one for each row, unless that records a deletion
+		queries = append(queries, fmt.Sprintf(`
+		    DELETE FROM %s WHERE id IN (
+		        SELECT h.id FROM %s h
+		        WHERE h.written < ? AND (
+		            h.id < (SELECT MAX(id) FROM %s l WHERE l.pk = h.pk AND l.sk = h.sk)
+		            OR h.deleted = 1
+		        )
+		        LIMIT ?
+		    );`, historyTable, historyTable, historyTable))
+		args = append(args, []interface{}{cutoff, batchSize})
+	}
+	total := 0
+	for i, query := range queries {
+		for {
+			if err := ctx.Err(); err != nil {
+				return total, err
+			}
+			var deleted int64
+			err := tm.db.Write(func(writeDB WriteDBHandler) error {
+				result, err := writeDB.ExecContext(ctx, query, args[i]...)
+				if err != nil {
+					return err
+				}
+				deleted, err = result.RowsAffected()
+				return err
+			})
+			if err != nil {
+				return total, fmt.Errorf("failed to prune history table %s: %w", historyTable, err)
+			}
+			total += int(deleted)
+			if int(deleted) < batchSize {
+				break
+			}
+		}
+	}
+	// Versions recorded after latestID was read are checked next time
+	tm.historyPrunedID.CompareAndSwap(prunedID, latestID)
+	return total, nil
+}
@@ -0,0 +1,156 @@
+package greener_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestKVHistory(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	db := newTestBatchDB(t, "kvhistory")
+	kv, err := greener.NewKVTable(ctx, db, "audited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.EnableHistory(ctx, greener.KVHistoryPolicy{KeepVersions: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each change is made a few milliseconds apart so the times between them are unambiguous
+	var times []time.Time
+	mark := func() {
+		time.Sleep(5 * time.Millisecond)
+		times = append(times, time.Now())
+		time.Sleep(5 * time.Millisecond)
+	}
+	mark()
+	if err := kv.Put(ctx, "doc", "1", greener.JSONValue{"title": "first"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	mark()
+	if _, err := kv.Patch(ctx, "doc", "1", greener.JSONMergePatch{"title": "second"}); err != nil {
+		t.Fatal(err)
+	}
+	mark()
+	if _, err := kv.Increment(ctx, "doc", "1", "views", 1); err != nil {
+		t.Fatal(err)
+	}
+	mark()
+	if err := kv.Delete(ctx, "doc", "1"); err != nil {
+		t.Fatal(err)
+	}
+	mark()
+	if err := kv.Put(ctx, "doc", "1", greener.JSONValue{"title": "third"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	mark()
+
+	expected := []string{"", "first", "second", "second", "", "third"}
+	for i, title := range expected {
+		data, _, err := kv.GetAsOf(ctx, "doc", "1", times[i])
+		if title == "" {
+			if err != greener.ErrKVNotFound {
+				t.Fatalf("Expected no row at time %d, got %v %v", i, data, err)
+			}
+			continue
+		}
+		if err != nil || data["title"] != title {
+			t.Fatalf("Expected %q at time %d, got %v %v", title, i, data, err)
+		}
+	}
+	data, _, err := kv.GetAsOf(ctx, "doc", "1", times[3])
+	if err != nil || data["views"] != 1.0 {
+		t.Fatalf("Expected the incremented version, got %v %v", data, err)
+	}
+
+	versions, err := kv.History(ctx, "doc", "1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 5 || versions[0].Data["title"] != "third" || !versions[1].Deleted || versions[4].Data["title"] != "first" {
+		t.Fatalf("Unexpected history: %+v", versions)
+	}
+	versions, err = kv.History(ctx, "doc", "1", 2)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected 2 versions with a limit, got %d %v", len(versions), err)
+	}
+
+	// The retention policy is applied by the cleanup routine
+	if _, err := kv.DeleteExpired(ctx, greener.KVExpiryOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = kv.History(ctx, "doc", "1", 0)
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("Expected 3 versions after pruning, got %d %v", len(versions), err)
+	}
+	if _, _, err := kv.GetAsOf(ctx, "doc", "1", times[1]); err != greener.ErrKVNotFound {
+		t.Fatalf("Expected a pruned version not to be found, got %v", err)
+	}
+
+	// Only rows changed since the last prune are checked, so new versions must still be pruned
+	for _, title := range []string{"fourth", "fifth"} {
+		if err := kv.Put(ctx, "doc", "1", greener.JSONValue{"title": title}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := kv.DeleteExpired(ctx, greener.KVExpiryOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = kv.History(ctx, "doc", "1", 0)
+	if err != nil || len(versions) != 3 || versions[0].Data["title"] != "fifth" {
+		t.Fatalf("Expected 3 versions after pruning again, got %+v %v", versions, err)
+	}
+
+	// The history table's name can't clash with a KV's
+	other, err := greener.NewKVTable(ctx, db, "audited_history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Put(ctx, "doc", "1", greener.JSONValue{"title": "other"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err = other.Get(ctx, "doc", "1")
+	if err != nil || data["title"] != "other" {
+		t.Fatalf("Expected the other KV to work alongside the history, got %v %v", data, err)
+	}
+	versions, err = kv.History(ctx, "doc", "1", 0)
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("Expected the other KV not to affect the history, got %d %v", len(versions), err)
+	}
+
+	if err := kv.DisableHistory(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Put(ctx, "doc", "1", greener.JSONValue{"title": "untracked"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = kv.History(ctx, "doc", "1", 0)
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("Expected history to stop being recorded, got %d versions %v", len(versions), err)
+	}
+
+	if err := kv.EnableHistory(ctx, greener.KVHistoryPolicy{MaxAge: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range []string{"a", "b", "c"} {
+		if err := kv.Put(ctx, "aged", "1", greener.JSONValue{"title": title}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := kv.DeleteExpired(ctx, greener.KVExpiryOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = kv.History(ctx, "aged", "1", 0)
+	if err != nil || len(versions) != 1 || versions[0].Data["title"] != "c" {
+		t.Fatalf("Expected only the latest version to survive MaxAge, got %+v %v", versions, err)
+	}
+}
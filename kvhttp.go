@@ -0,0 +1,248 @@
+package greener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KVTTLHeader is the request header a PUT can use to set the number of seconds until the row expires.
+const KVTTLHeader = "X-TTL-Seconds"
+
+// KVExpiresHeader is the response header a GET uses to report when the row expires, in RFC 3339 format.
+const KVExpiresHeader = "X-Expires"
+
+// KVAuthorizer decides whether a request may access the partition pk. Returning an error rejects the request with 403 Forbidden.
+type KVAuthorizer func(r *http.Request, pk string) error
+
+// KVHandler is an http.Handler that exposes a KV as JSON over REST:
+//
+//	GET    /{pk}/{sk}               returns the row's data with an ETag
+//	PUT    /{pk}/{sk}               stores the JSON object in the body
+//	DELETE /{pk}/{sk}               removes the row
+//	GET    /{pk}?after=&limit=      lists rows in the partition, with after in the response empty on the last page
+//
+// The pk and sk are single path segments, so any slashes in them must be escaped as %2F. Mount the handler with http.StripPrefix if it doesn't live at the root. PUT and DELETE honour If-Match and If-None-Match, checked atomically in the same transaction as the write.
+type KVHandler struct {
+	kv           *KV
+	authorize    KVAuthorizer
+	maxBodyBytes int64
+	maxLimit     int
+}
+
+// NewKVHandler creates a KVHandler. The authorizer is called for every request and may be nil to allow everything.
+func NewKVHandler(kv *KV, authorize KVAuthorizer) *KVHandler {
+	return &KVHandler{kv: kv, authorize: authorize, maxBodyBytes: 1 << 20, maxLimit: 1000}
+}
+
+type kvListResponse struct {
+	Rows  []kvListRow `json:"rows"`
+	After string      `json:"after"`
+}
+
+type kvListRow struct {
+	SK      string     `json:"sk"`
+	Data    JSONValue  `json:"data"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (h *KVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil || unescaped == "" {
+			http.Error(w, "Invalid path", http.StatusNotFound)
+			return
+		}
+		segments = append(segments, unescaped)
+	}
+	if len(segments) < 1 || len(segments) > 2 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	pk := segments[0]
+	if h.authorize != nil {
+		if err := h.authorize(r, pk); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if len(segments) == 1 {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.list(w, r, pk)
+		return
+	}
+	sk := segments[1]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.get(w, r, pk, sk)
+	case http.MethodPut:
+		h.put(w, r, pk, sk)
+	case http.MethodDelete:
+		h.delete(w, r, pk, sk)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *KVHandler) list(w http.ResponseWriter, r *http.Request, pk string) {
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	if limit > h.maxLimit {
+		limit = h.maxLimit
+	}
+	after := r.URL.Query().Get("after")
+	rows, newAfter, err := h.kv.Iterate(r.Context(), pk, after, limit, after != "")
+	if err != nil {
+		http.Error(w, "Failed to list rows", http.StatusInternalServerError)
+		return
+	}
+	response := kvListResponse{Rows: []kvListRow{}}
+	// A short page is the last one
+	if len(rows) == limit {
+		response.After = newAfter
+	}
+	for _, row := range rows {
+		response.Rows = append(response.Rows, kvListRow{SK: row.SK, Data: row.Data, Expires: row.Expires})
+	}
+	writeKVJSON(w, http.StatusOK, response)
+}
+
+func (h *KVHandler) get(w http.ResponseWriter, r *http.Request, pk, sk string) {
+	data, expires, err := h.kv.Get(r.Context(), pk, sk)
+	if errors.Is(err, ErrKVNotFound) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get row", http.StatusInternalServerError)
+		return
+	}
+	etag, err := kvETag(data)
+	if err != nil {
+		http.Error(w, "Failed to encode row", http.StatusInternalServerError)
+		return
+	}
+	etag = "\"" + etag + "\""
+	w.Header().Set("ETag", etag)
+	if expires != nil {
+		w.Header().Set(KVExpiresHeader, expires.UTC().Format(time.RFC3339))
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if match = strings.TrimSpace(match); match == "*" || EtagMatch(match, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	writeKVJSON(w, http.StatusOK, data)
+}
+
+// preconditionsMet applies If-Match and If-None-Match to the current value of a row, which is nil if it doesn't exist.
+func preconditionsMet(r *http.Request, current JSONValue) bool {
+	var currentETag string
+	if current != nil {
+		etag, err := kvETag(current)
+		if err != nil {
+			return false
+		}
+		currentETag = etag
+	}
+	if match := strings.TrimSpace(r.Header.Get("If-Match")); match != "" {
+		if current == nil {
+			return false
+		}
+		if match != "*" && !EtagMatch(match, currentETag) {
+			return false
+		}
+	}
+	if match := strings.TrimSpace(r.Header.Get("If-None-Match")); match != "" && current != nil {
+		if match == "*" || EtagMatch(match, currentETag) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *KVHandler) put(w http.ResponseWriter, r *http.Request, pk, sk string) {
+	var data JSONValue
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxBodyBytes)).Decode(&data); err != nil || data == nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	var expires *time.Time
+	if ttl := r.Header.Get(KVTTLHeader); ttl != "" {
+		seconds, err := strconv.Atoi(ttl)
+		if err != nil || seconds < 1 {
+			http.Error(w, fmt.Sprintf("Invalid %s header", KVTTLHeader), http.StatusBadRequest)
+			return
+		}
+		t := time.Now().Add(time.Duration(seconds) * time.Second)
+		expires = &t
+	}
+	etag, err := kvETag(data)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	current, applied, err := h.kv.writeIf(r.Context(), pk, sk, data, expires, func(current JSONValue) bool {
+		return preconditionsMet(r, current)
+	})
+	if err != nil {
+		http.Error(w, "Failed to store row", http.StatusInternalServerError)
+		return
+	}
+	if !applied {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	w.Header().Set("ETag", "\""+etag+"\"")
+	if current == nil {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *KVHandler) delete(w http.ResponseWriter, r *http.Request, pk, sk string) {
+	_, applied, err := h.kv.writeIf(r.Context(), pk, sk, nil, nil, func(current JSONValue) bool {
+		return preconditionsMet(r, current)
+	})
+	if err != nil {
+		http.Error(w, "Failed to delete row", http.StatusInternalServerError)
+		return
+	}
+	if !applied {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeKVJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,129 @@
+package greener_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestKVHandler(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	db := newTestBatchDB(t, "kvhttp")
+	kv, err := greener.NewKV(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := greener.NewKVHandler(kv, func(r *http.Request, pk string) error {
+		if strings.HasPrefix(pk, "private") {
+			return errors.New("forbidden")
+		}
+		return nil
+	})
+	do := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("PUT", "/users%2F1/profile", `{"name": "Ann"}`, map[string]string{"If-None-Match": "*", greener.KVTTLHeader: "3600"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 creating a row, got %d", rec.Code)
+	}
+	etag := rec.Header().Get("ETag")
+
+	rec = do("PUT", "/users%2F1/profile", `{"name": "Bob"}`, map[string]string{"If-None-Match": "*"})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 creating an existing row, got %d", rec.Code)
+	}
+
+	rec = do("GET", "/users%2F1/profile", "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != etag || rec.Header().Get(greener.KVExpiresHeader) == "" {
+		t.Fatalf("Unexpected GET response %d with headers %v", rec.Code, rec.Header())
+	}
+	var data greener.JSONValue
+	if err := json.Unmarshal(rec.Body.Bytes(), &data); err != nil || data["name"] != "Ann" {
+		t.Fatalf("Unexpected GET body %s: %v", rec.Body.String(), err)
+	}
+
+	rec = do("GET", "/users%2F1/profile", "", map[string]string{"If-None-Match": etag})
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("Expected 304, got %d", rec.Code)
+	}
+
+	rec = do("PUT", "/users%2F1/profile", `{"name": "Bob"}`, map[string]string{"If-Match": `"stale"`})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 with a stale If-Match, got %d", rec.Code)
+	}
+	rec = do("PUT", "/users%2F1/profile", `{"name": "Bob"}`, map[string]string{"If-Match": etag})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 with a matching If-Match, got %d", rec.Code)
+	}
+	newETag := rec.Header().Get("ETag")
+
+	for _, sk := range []string{"a", "b", "c"} {
+		if rec = do("PUT", "/list/"+sk, `{"n": 1}`, nil); rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", rec.Code)
+		}
+	}
+	rec = do("GET", "/list?limit=2", "", nil)
+	var page struct {
+		Rows []struct {
+			SK string `json:"sk"`
+		} `json:"rows"`
+		After string `json:"after"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || len(page.Rows) != 2 || page.After != "b" {
+		t.Fatalf("Unexpected first page %s: %v", rec.Body.String(), err)
+	}
+	rec = do("GET", "/list?limit=2&after="+page.After, "", nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || len(page.Rows) != 1 || page.Rows[0].SK != "c" || page.After != "" {
+		t.Fatalf("Unexpected last page %s: %v", rec.Body.String(), err)
+	}
+
+	if rec = do("GET", "/users%2F1/missing", "", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing row, got %d", rec.Code)
+	}
+	err = db.Write(func(d greener.WriteDBHandler) error {
+		_, err := d.ExecContext(ctx, "INSERT INTO kv (pk, sk, data) VALUES ('corrupt', 'row', 'not json')")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec = do("GET", "/corrupt/row", "", nil); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500 when the row can't be read, got %d", rec.Code)
+	}
+
+	if rec = do("GET", "/private/x", "", nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 from the authorizer, got %d", rec.Code)
+	}
+	if rec = do("PUT", "/users%2F1/bad", `not json`, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for invalid JSON, got %d", rec.Code)
+	}
+
+	if rec = do("DELETE", "/users%2F1/profile", "", map[string]string{"If-Match": etag}); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 deleting with a stale ETag, got %d", rec.Code)
+	}
+	if rec = do("DELETE", "/users%2F1/profile", "", map[string]string{"If-Match": newETag}); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 deleting, got %d", rec.Code)
+	}
+	if rec = do("GET", "/users%2F1/profile", "", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 after delete, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,258 @@
+package greener
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+// KVRecord is one line of the JSON Lines format used by Export and Import.
+type KVRecord struct {
+	PK      string     `json:"pk"`
+	SK      string     `json:"sk"`
+	Data    JSONValue  `json:"data"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// KVExportFilter chooses which rows Export writes.
+type KVExportFilter struct {
+	// PKPrefix restricts the export to partitions whose pk starts with this prefix.
+	PKPrefix string
+	// IncludeExpired exports rows that have expired but haven't been cleaned up yet.
+	IncludeExpired bool
+}
+
+// KVImportMode decides what Import does when a row already exists.
+type KVImportMode int
+
+const (
+	// KVImportUpsert overwrites existing rows.
+	KVImportUpsert KVImportMode = iota
+	// KVImportCreate leaves existing rows alone and skips the imported record. Rows that have expired but haven't been cleaned up yet are overwritten, as they are by Create.
+	KVImportCreate
+)
+
+// KVImportStats reports what Import did.
+type KVImportStats struct {
+	Written int
+	Skipped int
+}
+
+// KVImportAction describes what Import would do with a record.
+type KVImportAction string
+
+const (
+	KVImportActionCreate    KVImportAction = "create"
+	KVImportActionUpdate    KVImportAction = "update"
+	KVImportActionUnchanged KVImportAction = "unchanged"
+	KVImportActionSkip      KVImportAction = "skip"
+)
+
+// KVImportChange is reported by DiffImport for each record read.
+type KVImportChange struct {
+	Action KVImportAction
+	Record KVRecord
+	// Current is the existing row, or nil if there isn't one.
+	Current *KVRecord
+}
+
+// importChunkSize is the number of records Import writes in each BatchDB write.
+const importChunkSize = 500
+
+// Export writes the rows matching filter to w as JSON Lines, one KVRecord per line, ordered by pk and sk. It returns the number of rows written.
+func (tm *KV) Export(ctx context.Context, w io.Writer, filter KVExportFilter) (int, error) {
+	tableName := tm.table
+	querySQL := fmt.Sprintf("SELECT pk, sk, data, expires FROM %s WHERE pk >= ?", tableName)
+	args := []interface{}{filter.PKPrefix}
+	if upper, ok := prefixUpperBound(filter.PKPrefix); ok && filter.PKPrefix != "" {
+		querySQL += " AND pk < ?"
+		args = append(args, upper)
+	}
+	if !filter.IncludeExpired {
+		querySQL += " AND (expires IS NULL OR expires > ?)"
+		args = append(args, kvNow())
+	}
+	querySQL += " ORDER BY pk, sk"
+
+	sqlRows, err := tm.db.QueryContext(ctx, querySQL, args...)
+	if err != nil {
+		return 0, fmt.Errorf("error executing export query: %w", err)
+	}
+	defer sqlRows.Close()
+
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	count := 0
+	for sqlRows.Next() {
+		r, err := scanRow(sqlRows)
+		if err != nil {
+			return count, err
+		}
+		if err := encoder.Encode(KVRecord{PK: r.PK, SK: r.SK, Data: r.Data, Expires: r.Expires}); err != nil {
+			return count, fmt.Errorf("error writing record: %w", err)
+		}
+		count++
+	}
+	if err := sqlRows.Err(); err != nil {
+		return count, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return count, buffered.Flush()
+}
+
+// kvRecordReader decodes KVRecords from JSON Lines, keeping track of the line number for error messages.
+type kvRecordReader struct {
+	decoder *json.Decoder
+	line    int
+}
+
+func newKVRecordReader(r io.Reader) *kvRecordReader {
+	return &kvRecordReader{decoder: json.NewDecoder(r)}
+}
+
+func (rr *kvRecordReader) next() (KVRecord, error) {
+	var record KVRecord
+	rr.line++
+	if err := rr.decoder.Decode(&record); err != nil {
+		if errors.Is(err, io.EOF) {
+			return record, io.EOF
+		}
+		return record, fmt.Errorf("record %d: %w", rr.line, err)
+	}
+	if record.PK == "" || record.SK == "" || record.Data == nil {
+		return record, fmt.Errorf("record %d: pk, sk and data are all required", rr.line)
+	}
+	return record, nil
+}
+
+// Import reads JSON Lines in the format written by Export and stores each record. Records are written in chunks, each in its own BatchDB write, so if an invalid record is found part way through, the chunks before it will already have been committed.
+func (tm *KV) Import(ctx context.Context, r io.Reader, mode KVImportMode) (KVImportStats, error) {
+	var stats KVImportStats
+	reader := newKVRecordReader(r)
+	for {
+		var chunk []KVRecord
+		var readErr error
+		for len(chunk) < importChunkSize {
+			record, err := reader.next()
+			if err != nil {
+				readErr = err
+				break
+			}
+			chunk = append(chunk, record)
+		}
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return stats, readErr
+		}
+		if len(chunk) > 0 {
+			written, err := tm.importChunk(ctx, chunk, mode)
+			if err != nil {
+				return stats, err
+			}
+			stats.Written += written
+			stats.Skipped += len(chunk) - written
+		}
+		if readErr != nil {
+			return stats, nil
+		}
+	}
+}
+
+func (tm *KV) importChunk(ctx context.Context, chunk []KVRecord, mode KVImportMode) (int, error) {
+	tableName := tm.table
+	conflict := "DO UPDATE SET data=excluded.data, expires=excluded.expires"
+	if mode == KVImportCreate {
+		// An expired row that hasn't been cleaned up yet doesn't count as existing, just as for Create
+		conflict += " WHERE expires IS NOT NULL AND expires <= ?"
+	}
+	insertSQL := fmt.Sprintf(`
+	    INSERT INTO %s (pk, sk, data, expires) VALUES (?, ?, ?, ?)
+	    ON CONFLICT(pk, sk) %s;
+	`, tableName, conflict)
+
+	encoded := make([][]byte, len(chunk))
+	for i, record := range chunk {
+		jsonData, err := json.Marshal(record.Data)
+		if err != nil {
+			return 0, fmt.Errorf("error encoding data for pk %s and sk %s: %w", record.PK, record.SK, err)
+		}
+		encoded[i] = jsonData
+	}
+
+	var written []KVRecord
+	err := tm.db.Write(func(writeDB WriteDBHandler) error {
+		written = written[:0]
+		for i, record := range chunk {
+			args := []interface{}{record.PK, record.SK, encoded[i], expiresToDB(record.Expires)}
+			if mode == KVImportCreate {
+				args = append(args, kvNow())
+			}
+			result, err := writeDB.ExecContext(ctx, insertSQL, args...)
+			if err != nil {
+				return fmt.Errorf("failed to import row in table %s: %w", tableName, err)
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				written = append(written, record)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	events := make([]KVEvent, len(written))
+	for i, record := range written {
+		events[i] = KVEvent{Type: KVEventPut, PK: record.PK, SK: record.SK, Data: record.Data, Expires: record.Expires}
+	}
+	tm.committed(events...)
+	return len(written), nil
+}
+
+// DiffImport reads records like Import but doesn't write anything. Instead it calls fn with the change Import would make for each record, so you can do a dry run. Expired rows are compared as if they didn't exist, since Import would make them visible again.
+func (tm *KV) DiffImport(ctx context.Context, r io.Reader, mode KVImportMode, fn func(KVImportChange) error) error {
+	reader := newKVRecordReader(r)
+	for {
+		record, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		change := KVImportChange{Record: record}
+		data, expires, err := tm.Get(ctx, record.PK, record.SK)
+		if err != nil && !errors.Is(err, ErrKVNotFound) {
+			return err
+		}
+		switch {
+		case err != nil:
+			change.Action = KVImportActionCreate
+		case mode == KVImportCreate:
+			change.Action = KVImportActionSkip
+			change.Current = &KVRecord{PK: record.PK, SK: record.SK, Data: data, Expires: expires}
+		default:
+			change.Current = &KVRecord{PK: record.PK, SK: record.SK, Data: data, Expires: expires}
+			change.Action = KVImportActionUpdate
+			if reflect.DeepEqual(data, record.Data) && sameExpiry(expires, record.Expires) {
+				change.Action = KVImportActionUnchanged
+			}
+		}
+		if err := fn(change); err != nil {
+			return err
+		}
+	}
+}
+
+func sameExpiry(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.UnixMilli() == b.UnixMilli()
+}
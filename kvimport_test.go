@@ -0,0 +1,123 @@
+package greener_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestKVImportExport(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	db := newTestBatchDB(t, "kvimport")
+	source, err := greener.NewKVTable(ctx, db, "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := greener.NewKVTable(ctx, db, "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	past := time.Now().Add(-time.Hour)
+	for i := 0; i < 600; i++ {
+		if err := source.Put(ctx, "users", fmt.Sprintf("user%04d", i), greener.JSONValue{"i": float64(i)}, &expires); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := source.Put(ctx, "other", "row", greener.JSONValue{"name": "other"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Put(ctx, "users", "expired", greener.JSONValue{"name": "expired"}, &past); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	count, err := source.Export(ctx, &buf, greener.KVExportFilter{PKPrefix: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 600 || strings.Count(buf.String(), "\n") != 600 {
+		t.Fatalf("Expected 600 exported lines, got %d", count)
+	}
+	exported := buf.String()
+
+	stats, err := target.Import(ctx, strings.NewReader(exported), greener.KVImportUpsert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 600 || stats.Skipped != 0 {
+		t.Fatalf("Unexpected import stats %+v", stats)
+	}
+	data, retrievedExpires, err := target.Get(ctx, "users", "user0042")
+	if err != nil || data["i"] != 42.0 || !retrievedExpires.Equal(expires) {
+		t.Fatalf("Imported row doesn't match: %v %v %v", data, retrievedExpires, err)
+	}
+
+	changed := `{"pk":"users","sk":"user0001","data":{"i":-1}}
+{"pk":"users","sk":"new","data":{"i":5000}}
+`
+	counts := map[greener.KVImportAction]int{}
+	err = target.DiffImport(ctx, strings.NewReader(exported+changed), greener.KVImportUpsert, func(change greener.KVImportChange) error {
+		counts[change.Action]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[greener.KVImportActionUnchanged] != 600 || counts[greener.KVImportActionUpdate] != 1 || counts[greener.KVImportActionCreate] != 1 {
+		t.Fatalf("Unexpected dry run counts %v", counts)
+	}
+	if _, _, err := target.Get(ctx, "users", "new"); err == nil {
+		t.Fatalf("DiffImport wrote a row")
+	}
+
+	stats, err = target.Import(ctx, strings.NewReader(changed), greener.KVImportCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 1 || stats.Skipped != 1 {
+		t.Fatalf("Unexpected create mode stats %+v", stats)
+	}
+	data, _, _ = target.Get(ctx, "users", "user0001")
+	if data["i"] != 1.0 {
+		t.Fatalf("Create mode overwrote an existing row: %v", data)
+	}
+
+	// An expired row that hasn't been cleaned up yet is reported as a create and then created
+	if err := target.Put(ctx, "users", "expired", greener.JSONValue{"i": -2.0}, &past); err != nil {
+		t.Fatal(err)
+	}
+	revived := `{"pk":"users","sk":"expired","data":{"i":7}}
+`
+	var actions []greener.KVImportAction
+	err = target.DiffImport(ctx, strings.NewReader(revived), greener.KVImportCreate, func(change greener.KVImportChange) error {
+		actions = append(actions, change.Action)
+		return nil
+	})
+	if err != nil || len(actions) != 1 || actions[0] != greener.KVImportActionCreate {
+		t.Fatalf("Expected the expired row to be a create, got %v %v", actions, err)
+	}
+	stats, err = target.Import(ctx, strings.NewReader(revived), greener.KVImportCreate)
+	if err != nil || stats.Written != 1 || stats.Skipped != 0 {
+		t.Fatalf("Unexpected create mode stats for an expired row %+v %v", stats, err)
+	}
+	data, expiresAt, err := target.Get(ctx, "users", "expired")
+	if err != nil || data["i"] != 7.0 || expiresAt != nil {
+		t.Fatalf("Expected the expired row to be replaced, got %v %v %v", data, expiresAt, err)
+	}
+
+	if _, err := target.Import(ctx, strings.NewReader(`{"pk":"users","sk":"bad"}`), greener.KVImportUpsert); err == nil {
+		t.Fatalf("Expected a record without data to be rejected")
+	}
+}
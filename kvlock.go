@@ -0,0 +1,229 @@
+package greener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLockHeld is returned by Acquire when another owner holds an unexpired lease on the lock.
+var ErrLockHeld = errors.New("lock is held by another owner")
+
+// ErrLockNotHeld is returned by Renew and Release when the lease has expired or the lock has since been acquired by someone else.
+var ErrLockNotHeld = errors.New("lock is not held by this lease")
+
+// KVLease is a time limited hold on a named lock.
+type KVLease struct {
+	Name  string
+	Owner string
+	// Token is a fencing token. It increases every time the lock is newly acquired, so a resource protected by the lock can reject writes carrying a token lower than the highest it has seen, even from an owner whose lease expired without it noticing.
+	Token   int64
+	Expires time.Time
+}
+
+// KVLocks provides named locks for processes sharing a database file. Each lock is a row in the partition given to NewKVLocks, which expires along with the lease, so a lock held by a process that dies is freed automatically. The fencing token counters are kept without an expiry in a second partition, so tokens never go backwards.
+type KVLocks struct {
+	kv             *KV
+	partition      string
+	tokenPartition string
+}
+
+// NewKVLocks creates a KVLocks that stores its locks in the given partition of kv and their fencing token counters in tokenPartition. KV allows any string as a partition, so both are chosen by the caller rather than derived from each other, and neither should be used for anything else.
+func NewKVLocks(kv *KV, partition string, tokenPartition string) (*KVLocks, error) {
+	if partition == "" || tokenPartition == "" {
+		return nil, fmt.Errorf("lock partitions must not be empty")
+	}
+	if partition == tokenPartition {
+		return nil, fmt.Errorf("lock partition and token partition must be different, both are %q", partition)
+	}
+	return &KVLocks{kv: kv, partition: partition, tokenPartition: tokenPartition}, nil
+}
+
+// currentLease reads the unexpired lease on a lock inside a write, returning nil if there isn't one.
+func (l *KVLocks) currentLease(ctx context.Context, writeDB WriteDBHandler, name string) (*KVLease, error) {
+	rows, err := writeDB.QueryContext(ctx, fmt.Sprintf("SELECT data, expires FROM %s WHERE pk = ? AND sk = ? AND (expires IS NULL OR expires > ?)", l.kv.table), l.partition, name, kvNow())
+	if err != nil {
+		return nil, fmt.Errorf("error querying for lock: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var jsonData string
+	var expiresUnix sql.NullFloat64
+	if err := rows.Scan(&jsonData, &expiresUnix); err != nil {
+		return nil, fmt.Errorf("error scanning lock: %w", err)
+	}
+	var data JSONValue
+	if err := json.Unmarshal([]byte(jsonData), &data); err != nil {
+		return nil, fmt.Errorf("error decoding lock from JSON: %w", err)
+	}
+	owner, _ := data["owner"].(string)
+	token, _ := data["token"].(float64)
+	lease := &KVLease{Name: name, Owner: owner, Token: int64(token)}
+	if expires := expiresFromDB(expiresUnix); expires != nil {
+		lease.Expires = *expires
+	}
+	return lease, rows.Close()
+}
+
+// nextToken increments and returns the fencing token counter for a lock inside a write.
+func (l *KVLocks) nextToken(ctx context.Context, writeDB WriteDBHandler, name string) (int64, error) {
+	rows, err := writeDB.QueryContext(ctx, fmt.Sprintf(`
+	    INSERT INTO %s (pk, sk, data, expires) VALUES (?, ?, json_object('token', 1), NULL)
+	    ON CONFLICT(pk, sk) DO UPDATE SET data = json_set(data, '$.token', json_extract(data, '$.token') + 1), expires = NULL
+	    RETURNING json_extract(data, '$.token');
+	`, l.kv.table), l.tokenPartition, name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment fencing token: %w", err)
+	}
+	defer rows.Close()
+	var token int64
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("failed to increment fencing token for lock %s", name)
+	}
+	if err := rows.Scan(&token); err != nil {
+		return 0, fmt.Errorf("error scanning fencing token: %w", err)
+	}
+	return token, rows.Close()
+}
+
+// writeLease stores a lease inside a write.
+func (l *KVLocks) writeLease(ctx context.Context, writeDB WriteDBHandler, lease KVLease) error {
+	jsonData, err := json.Marshal(l.leaseData(lease))
+	if err != nil {
+		return fmt.Errorf("error encoding lock to JSON: %w", err)
+	}
+	_, err = writeDB.ExecContext(ctx, fmt.Sprintf(`
+	    INSERT INTO %s (pk, sk, data, expires) VALUES (?, ?, ?, ?)
+	    ON CONFLICT(pk, sk) DO UPDATE SET data=excluded.data, expires=excluded.expires;
+	`, l.kv.table), l.partition, lease.Name, jsonData, expiresToDB(&lease.Expires))
+	if err != nil {
+		return fmt.Errorf("failed to write lock %s: %w", lease.Name, err)
+	}
+	return nil
+}
+
+func (l *KVLocks) leaseData(lease KVLease) JSONValue {
+	return JSONValue{"owner": lease.Owner, "token": float64(lease.Token)}
+}
+
+// Acquire takes the lock called name for owner until ttl has passed, returning ErrLockHeld if another owner holds it. If owner already holds the lock, the lease is extended and keeps its fencing token, so a retried Acquire is harmless. The check and the write happen atomically in one BatchDB write.
+func (l *KVLocks) Acquire(ctx context.Context, name string, owner string, ttl time.Duration) (KVLease, error) {
+	if owner == "" {
+		return KVLease{}, fmt.Errorf("lock owner must not be empty")
+	}
+	if ttl <= 0 {
+		return KVLease{}, fmt.Errorf("lock ttl must be positive, got %s", ttl)
+	}
+	var lease KVLease
+	held, newToken := false, false
+	err := l.kv.db.Write(func(writeDB WriteDBHandler) error {
+		held, newToken = false, false
+		current, err := l.currentLease(ctx, writeDB, name)
+		if err != nil {
+			return err
+		}
+		if current != nil && current.Owner != owner {
+			held = true
+			return nil
+		}
+		lease = KVLease{Name: name, Owner: owner, Expires: time.Now().Add(ttl).Truncate(time.Millisecond)}
+		if current != nil {
+			lease.Token = current.Token
+		} else if lease.Token, err = l.nextToken(ctx, writeDB, name); err != nil {
+			return err
+		} else {
+			newToken = true
+		}
+		return l.writeLease(ctx, writeDB, lease)
+	})
+	if err != nil {
+		return KVLease{}, fmt.Errorf("failed to acquire lock %s: %w", name, err)
+	}
+	if held {
+		return KVLease{}, fmt.Errorf("%w: %s", ErrLockHeld, name)
+	}
+	events := []KVEvent{{Type: KVEventPut, PK: l.partition, SK: name, Data: l.leaseData(lease), Expires: &lease.Expires}}
+	if newToken {
+		events = append(events, KVEvent{Type: KVEventPut, PK: l.tokenPartition, SK: name, Data: JSONValue{"token": float64(lease.Token)}})
+	}
+	l.kv.committed(events...)
+	return lease, nil
+}
+
+// Renew extends a lease so that it expires ttl from now. It returns ErrLockNotHeld if the lease has already expired or been released.
+func (l *KVLocks) Renew(ctx context.Context, lease KVLease, ttl time.Duration) (KVLease, error) {
+	if ttl <= 0 {
+		return KVLease{}, fmt.Errorf("lock ttl must be positive, got %s", ttl)
+	}
+	var renewed KVLease
+	notHeld := false
+	err := l.kv.db.Write(func(writeDB WriteDBHandler) error {
+		notHeld = false
+		current, err := l.currentLease(ctx, writeDB, lease.Name)
+		if err != nil {
+			return err
+		}
+		if current == nil || current.Owner != lease.Owner || current.Token != lease.Token {
+			notHeld = true
+			return nil
+		}
+		renewed = *current
+		renewed.Expires = time.Now().Add(ttl).Truncate(time.Millisecond)
+		return l.writeLease(ctx, writeDB, renewed)
+	})
+	if err != nil {
+		return KVLease{}, fmt.Errorf("failed to renew lock %s: %w", lease.Name, err)
+	}
+	if notHeld {
+		return KVLease{}, fmt.Errorf("%w: %s", ErrLockNotHeld, lease.Name)
+	}
+	l.kv.committed(KVEvent{Type: KVEventPut, PK: l.partition, SK: lease.Name, Data: l.leaseData(renewed), Expires: &renewed.Expires})
+	return renewed, nil
+}
+
+// Release gives up a lease so that others can acquire the lock straight away. It returns ErrLockNotHeld if the lease had already expired or been released, in which case the caller may not have had exclusive access for as long as it thought.
+func (l *KVLocks) Release(ctx context.Context, lease KVLease) error {
+	var deleted int64
+	err := l.kv.db.Write(func(writeDB WriteDBHandler) error {
+		result, err := writeDB.ExecContext(ctx, fmt.Sprintf(`
+		    DELETE FROM %s WHERE pk = ? AND sk = ? AND (expires IS NULL OR expires > ?)
+		    AND json_extract(data, '$.owner') = ? AND json_extract(data, '$.token') = ?;
+		`, l.kv.table), l.partition, lease.Name, kvNow(), lease.Owner, lease.Token)
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", lease.Name, err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%w: %s", ErrLockNotHeld, lease.Name)
+	}
+	l.kv.committed(KVEvent{Type: KVEventDelete, PK: l.partition, SK: lease.Name})
+	return nil
+}
+
+// Get returns the current lease on the lock called name, or ErrKVNotFound if nobody holds it.
+func (l *KVLocks) Get(ctx context.Context, name string) (KVLease, error) {
+	data, expires, err := l.kv.Get(ctx, l.partition, name)
+	if err != nil {
+		return KVLease{}, err
+	}
+	owner, _ := data["owner"].(string)
+	token, _ := data["token"].(float64)
+	lease := KVLease{Name: name, Owner: owner, Token: int64(token)}
+	if expires != nil {
+		lease.Expires = *expires
+	}
+	return lease, nil
+}
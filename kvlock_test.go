@@ -0,0 +1,140 @@
+package greener_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestKVLocks(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	kv, err := greener.NewKV(ctx, newTestBatchDB(t, "kvlocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks, err := greener.NewKVLocks(kv, "locks", "lock-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Acquire, Renew and Release", func(t *testing.T) {
+		lease, err := locks.Acquire(ctx, "job", "a", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease.Token != 1 || lease.Owner != "a" {
+			t.Fatalf("Unexpected lease %+v", lease)
+		}
+		if _, err := locks.Acquire(ctx, "job", "b", time.Minute); !errors.Is(err, greener.ErrLockHeld) {
+			t.Fatalf("Expected ErrLockHeld, got %v", err)
+		}
+		again, err := locks.Acquire(ctx, "job", "a", time.Minute)
+		if err != nil || again.Token != lease.Token {
+			t.Fatalf("Re-acquiring should keep the token, got %+v %v", again, err)
+		}
+		renewed, err := locks.Renew(ctx, lease, 2*time.Minute)
+		if err != nil || !renewed.Expires.After(lease.Expires) || renewed.Token != lease.Token {
+			t.Fatalf("Unexpected renewal %+v %v", renewed, err)
+		}
+		current, err := locks.Get(ctx, "job")
+		if err != nil || current.Owner != "a" || !current.Expires.Equal(renewed.Expires) {
+			t.Fatalf("Unexpected current lease %+v %v", current, err)
+		}
+		if err := locks.Release(ctx, greener.KVLease{Name: "job", Owner: "b", Token: lease.Token}); !errors.Is(err, greener.ErrLockNotHeld) {
+			t.Fatalf("Expected another owner's release to fail, got %v", err)
+		}
+		if err := locks.Release(ctx, renewed); err != nil {
+			t.Fatal(err)
+		}
+		if err := locks.Release(ctx, renewed); !errors.Is(err, greener.ErrLockNotHeld) {
+			t.Fatalf("Expected a second release to fail, got %v", err)
+		}
+		if _, err := locks.Renew(ctx, renewed, time.Minute); !errors.Is(err, greener.ErrLockNotHeld) {
+			t.Fatalf("Expected renewing a released lease to fail, got %v", err)
+		}
+		next, err := locks.Acquire(ctx, "job", "b", time.Minute)
+		if err != nil || next.Token != 2 {
+			t.Fatalf("Expected the fencing token to increase, got %+v %v", next, err)
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		lease, err := locks.Acquire(ctx, "short", "a", 30*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(40 * time.Millisecond)
+		if _, err := locks.Renew(ctx, lease, time.Minute); !errors.Is(err, greener.ErrLockNotHeld) {
+			t.Fatalf("Expected renewing an expired lease to fail, got %v", err)
+		}
+		taken, err := locks.Acquire(ctx, "short", "b", time.Minute)
+		if err != nil || taken.Token != lease.Token+1 {
+			t.Fatalf("Expected the expired lock to be taken with a new token, got %+v %v", taken, err)
+		}
+		if _, err := kv.DeleteExpired(ctx, greener.KVExpiryOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := locks.Release(ctx, lease); !errors.Is(err, greener.ErrLockNotHeld) {
+			t.Fatalf("Expected the stale lease not to release the new one, got %v", err)
+		}
+	})
+
+	t.Run("Mutual exclusion", func(t *testing.T) {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		winners := map[int64]string{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(owner string) {
+				defer wg.Done()
+				lease, err := locks.Acquire(ctx, "contended", owner, time.Minute)
+				if errors.Is(err, greener.ErrLockHeld) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Acquire failed: %v", err)
+					return
+				}
+				mu.Lock()
+				winners[lease.Token] = owner
+				mu.Unlock()
+			}(fmt.Sprintf("owner-%d", i))
+		}
+		wg.Wait()
+		if len(winners) != 1 {
+			t.Fatalf("Expected exactly one owner to acquire the lock, got %v", winners)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		if _, err := greener.NewKVLocks(kv, "locks", "locks"); err == nil {
+			t.Fatalf("Expected the same partition for locks and tokens to be rejected")
+		}
+		for _, ttl := range []time.Duration{0, -time.Second} {
+			if _, err := locks.Acquire(ctx, "ttl", "a", ttl); err == nil {
+				t.Fatalf("Expected Acquire to reject a ttl of %s", ttl)
+			}
+		}
+		lease, err := locks.Acquire(ctx, "ttl", "a", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := locks.Renew(ctx, lease, 0); err == nil {
+			t.Fatalf("Expected Renew to reject a ttl of zero")
+		}
+		data, expires, err := kv.Get(ctx, "lock-tokens", "ttl")
+		if err != nil || data["token"] != float64(lease.Token) || expires != nil {
+			t.Fatalf("Expected the token counter in the token partition, got %v %v %v", data, expires, err)
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package greener
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryRow struct {
+	data JSONValue
+	// expires is in Unix milliseconds, matching the precision KV stores, and is only set if expiring is true
+	expires  int64
+	expiring bool
+}
+
+func (r memoryRow) live(nowMilli int64) bool {
+	return !r.expiring || r.expires > nowMilli
+}
+
+func (r memoryRow) expiresTime() *time.Time {
+	if !r.expiring {
+		return nil
+	}
+	t := time.UnixMilli(r.expires)
+	return &t
+}
+
+// MemoryKV is a thread-safe, in-memory KvStore with the same semantics as KV for expiry, ordering and Create conflicts. It is useful in tests and for data that doesn't need to survive a restart. Expired rows are invisible straight away, but only freed by DeleteExpired.
+type MemoryKV struct {
+	mu           sync.RWMutex
+	partitions   map[string]map[string]memoryRow
+	cursorSecret string
+}
+
+var _ KvStore = (*MemoryKV)(nil)
+
+// NewMemoryKV returns an empty MemoryKV.
+func NewMemoryKV() *MemoryKV {
+	secret := make([]byte, 32)
+	// crypto/rand.Read only fails if the operating system can't provide randomness at all
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("failed to generate cursor secret: %v", err))
+	}
+	return &MemoryKV{partitions: make(map[string]map[string]memoryRow), cursorSecret: string(secret)}
+}
+
+// SetCursorSecret sets the key used to sign cursors, as for KV.
+func (m *MemoryKV) SetCursorSecret(secret string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cursorSecret = secret
+}
+
+func copyJSONValue(data JSONValue) JSONValue {
+	if data == nil {
+		return nil
+	}
+	c := make(JSONValue, len(data))
+	for k, v := range data {
+		c[k] = v
+	}
+	return c
+}
+
+// newMemoryRow copies data into a row that expires at expires, or never if expires is nil.
+func newMemoryRow(data JSONValue, expires *time.Time) memoryRow {
+	row := memoryRow{data: copyJSONValue(data)}
+	if expires != nil {
+		row.expires, row.expiring = expires.UnixMilli(), true
+	}
+	return row
+}
+
+// validateJSONValue checks data can be encoded, so MemoryKV rejects the same values KV does.
+func validateJSONValue(data JSONValue) error {
+	if _, err := data.MarshalJSON(); err != nil {
+		return fmt.Errorf("error encoding data to JSON: %w", err)
+	}
+	return nil
+}
+
+func (m *MemoryKV) set(pk, sk string, row memoryRow) {
+	partition, ok := m.partitions[pk]
+	if !ok {
+		partition = make(map[string]memoryRow)
+		m.partitions[pk] = partition
+	}
+	partition[sk] = row
+}
+
+// Put inserts or updates a row with the given pk, sk, data, and expires.
+func (m *MemoryKV) Put(ctx context.Context, pk string, sk string, data JSONValue, expires *time.Time) error {
+	if err := validateJSONValue(data); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(pk, sk, newMemoryRow(data, expires))
+	return nil
+}
+
+// Create inserts a row with the given pk, sk, data, and expires, but fails with ErrKVExists if an unexpired row already exists.
+func (m *MemoryKV) Create(ctx context.Context, pk string, sk string, data JSONValue, expires *time.Time) error {
+	if err := validateJSONValue(data); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.partitions[pk][sk]; ok && existing.live(time.Now().UnixMilli()) {
+		return fmt.Errorf("%w: pk %s and sk %s", ErrKVExists, pk, sk)
+	}
+	m.set(pk, sk, newMemoryRow(data, expires))
+	return nil
+}
+
+// Get retrieves a row with the given pk and sk. It returns ErrKVNotFound if the row doesn't exist or has expired.
+func (m *MemoryKV) Get(ctx context.Context, pk string, sk string) (JSONValue, *time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	row, ok := m.partitions[pk][sk]
+	if !ok || !row.live(time.Now().UnixMilli()) {
+		return nil, nil, ErrKVNotFound
+	}
+	return copyJSONValue(row.data), row.expiresTime(), nil
+}
+
+// Delete removes a row with the given pk and sk. Deleting a row that doesn't exist is not an error.
+func (m *MemoryKV) Delete(ctx context.Context, pk string, sk string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if partition, ok := m.partitions[pk]; ok {
+		delete(partition, sk)
+		if len(partition) == 0 {
+			delete(m.partitions, pk)
+		}
+	}
+	return nil
+}
+
+// DeleteExpired frees the memory used by expired rows and returns how many were removed.
+func (m *MemoryKV) DeleteExpired(ctx context.Context) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UnixMilli()
+	count := 0
+	for pk, partition := range m.partitions {
+		for sk, row := range partition {
+			if !row.live(now) {
+				delete(partition, sk)
+				count++
+			}
+		}
+		if len(partition) == 0 {
+			delete(m.partitions, pk)
+		}
+	}
+	return count
+}
+
+// sortedRows returns the unexpired rows in a partition that match keep, ordered by sk. It must be called with the lock held.
+func (m *MemoryKV) sortedRows(pk string, keep func(sk string) bool) []Row {
+	now := time.Now().UnixMilli()
+	var rows []Row
+	for sk, row := range m.partitions[pk] {
+		if row.live(now) && keep(sk) {
+			rows = append(rows, Row{PK: pk, SK: sk, Data: copyJSONValue(row.data), Expires: row.expiresTime()})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].SK < rows[j].SK })
+	return rows
+}
+
+// Iterate behaves like KV.Iterate: it returns up to limit rows in pk with sort keys from sk (or strictly after it if after is true), and the last sort key seen for pagination.
+func (m *MemoryKV) Iterate(ctx context.Context, pk, sk string, limit int, after bool) ([]Row, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rows := m.sortedRows(pk, func(rowSK string) bool {
+		if sk == "" {
+			return true
+		}
+		if after {
+			return rowSK > sk
+		}
+		return rowSK >= sk
+	})
+	// A negative limit means no limit, as it does in SQLite
+	if limit >= 0 && len(rows) > limit {
+		rows = rows[:limit]
+	}
+	newAfter := sk
+	if len(rows) > 0 {
+		newAfter = rows[len(rows)-1].SK
+	}
+	return rows, newAfter, nil
+}
+
+// Query behaves like KV.Query.
+func (m *MemoryKV) Query(ctx context.Context, pk string, q KVQuery) ([]Row, KVCursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var position *kvCursor
+	if q.Cursor != "" {
+		c, err := decodeCursor(m.cursorSecret, q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if c.Table != "" || c.PK != pk || c.Reverse != q.Reverse {
+			return nil, "", ErrInvalidCursor
+		}
+		position = &c
+	}
+	upper, hasUpper := prefixUpperBound(q.BeginsWith)
+	rows := m.sortedRows(pk, func(sk string) bool {
+		if q.BeginsWith != "" && (sk < q.BeginsWith || (hasUpper && sk >= upper)) {
+			return false
+		}
+		if q.Start != "" && sk < q.Start {
+			return false
+		}
+		if q.End != "" && sk > q.End {
+			return false
+		}
+		if position != nil {
+			if q.Reverse {
+				return sk < position.SK
+			}
+			return sk > position.SK
+		}
+		return true
+	})
+	if q.Reverse {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	var next KVCursor
+	if q.Limit > 0 && len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+		var err error
+		next, err = encodeCursor(m.cursorSecret, kvCursor{PK: pk, SK: rows[len(rows)-1].SK, Reverse: q.Reverse})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return rows, next, nil
+}
+
+// Increment behaves like KV.Increment.
+func (m *MemoryKV) Increment(ctx context.Context, pk string, sk string, field string, delta float64) (JSONValue, error) {
+	if _, err := jsonFieldPath(field); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	row, ok := m.partitions[pk][sk]
+	if !ok || !row.live(time.Now().UnixMilli()) {
+		row = memoryRow{data: JSONValue{field: delta}}
+	} else {
+		data := copyJSONValue(row.data)
+		switch current := data[field].(type) {
+		case nil:
+			data[field] = delta
+		case float64:
+			data[field] = current + delta
+		default:
+			return nil, fmt.Errorf("field %s of row with pk %s and sk %s is not a number", field, pk, sk)
+		}
+		row.data = data
+	}
+	m.set(pk, sk, row)
+	return copyJSONValue(row.data), nil
+}
+
+// Patch behaves like KV.Patch.
+func (m *MemoryKV) Patch(ctx context.Context, pk string, sk string, patch JSONMergePatch) (JSONValue, error) {
+	if _, err := patch.MarshalJSON(); err != nil {
+		return nil, fmt.Errorf("error encoding patch to JSON: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	row, ok := m.partitions[pk][sk]
+	if !ok || !row.live(time.Now().UnixMilli()) {
+		return nil, ErrKVNotFound
+	}
+	data := copyJSONValue(row.data)
+	for k, v := range patch {
+		if v == nil {
+			delete(data, k)
+		} else {
+			data[k] = v
+		}
+	}
+	row.data = data
+	m.set(pk, sk, row)
+	return copyJSONValue(data), nil
+}
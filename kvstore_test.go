@@ -0,0 +1,221 @@
+package greener_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+// testKvStoreConformance checks the behaviour every KvStore implementation must share.
+func testKvStoreConformance(t *testing.T, ctx context.Context, store greener.KvStore) {
+	sks := func(rows []greener.Row) []string {
+		result := []string{}
+		for _, row := range rows {
+			result = append(result, row.SK)
+		}
+		return result
+	}
+
+	t.Run("Put, Get and Delete", func(t *testing.T) {
+		expires := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+		data := greener.JSONValue{"name": "Ann", "age": 42.0}
+		if err := store.Put(ctx, "people", "ann", data, &expires); err != nil {
+			t.Fatal(err)
+		}
+		data["name"] = "changed after put"
+		got, gotExpires, err := store.Get(ctx, "people", "ann")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, greener.JSONValue{"name": "Ann", "age": 42.0}) || !gotExpires.Equal(expires) {
+			t.Fatalf("Unexpected Get result %v %v", got, gotExpires)
+		}
+		if err := store.Delete(ctx, "people", "ann"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Delete(ctx, "people", "ann"); err != nil {
+			t.Fatalf("Deleting a missing row should not be an error: %v", err)
+		}
+		if _, _, err := store.Get(ctx, "people", "ann"); !errors.Is(err, greener.ErrKVNotFound) {
+			t.Fatalf("Expected ErrKVNotFound after delete, got %v", err)
+		}
+		if err := store.Put(ctx, "people", "bad", greener.JSONValue{"list": []string{"a"}}, nil); err == nil {
+			t.Fatalf("Expected a value that isn't a string or number to be rejected")
+		}
+	})
+
+	t.Run("TTL and Create conflicts", func(t *testing.T) {
+		past := time.Now().Add(-time.Second)
+		if err := store.Put(ctx, "ttl", "expired", greener.JSONValue{"n": 1.0}, &past); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := store.Get(ctx, "ttl", "expired"); !errors.Is(err, greener.ErrKVNotFound) {
+			t.Fatalf("Expected an expired row not to be found, got %v", err)
+		}
+		if err := store.Create(ctx, "ttl", "expired", greener.JSONValue{"n": 2.0}, nil); err != nil {
+			t.Fatalf("Create over an expired row should succeed: %v", err)
+		}
+		if err := store.Create(ctx, "ttl", "expired", greener.JSONValue{"n": 3.0}, nil); !errors.Is(err, greener.ErrKVExists) {
+			t.Fatalf("Expected ErrKVExists creating a live row, got %v", err)
+		}
+		data, expires, err := store.Get(ctx, "ttl", "expired")
+		if err != nil || data["n"] != 2.0 || expires != nil {
+			t.Fatalf("Unexpected row after create: %v %v %v", data, expires, err)
+		}
+		// The epoch is a time like any other, not a way of saying the row never expires
+		epoch := time.UnixMilli(0)
+		if err := store.Put(ctx, "ttl", "epoch", greener.JSONValue{"n": 1.0}, &epoch); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := store.Get(ctx, "ttl", "epoch"); !errors.Is(err, greener.ErrKVNotFound) {
+			t.Fatalf("Expected a row that expired at the epoch not to be found, got %v", err)
+		}
+		soon := time.Now().Add(50 * time.Millisecond)
+		if err := store.Put(ctx, "ttl", "soon", greener.JSONValue{"n": 1.0}, &soon); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := store.Get(ctx, "ttl", "soon"); err != nil {
+			t.Fatalf("Row expired too soon: %v", err)
+		}
+		time.Sleep(time.Until(soon) + 5*time.Millisecond)
+		if _, _, err := store.Get(ctx, "ttl", "soon"); !errors.Is(err, greener.ErrKVNotFound) {
+			t.Fatalf("Expected the row to have expired, got %v", err)
+		}
+	})
+
+	t.Run("Ordering, Iterate and Query", func(t *testing.T) {
+		past := time.Now().Add(-time.Second)
+		for _, sk := range []string{"b", "a", "ab", "B", "é", "c"} {
+			if err := store.Put(ctx, "order", sk, greener.JSONValue{"sk": sk}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Put(ctx, "order", "aa-expired", greener.JSONValue{"sk": "expired"}, &past); err != nil {
+			t.Fatal(err)
+		}
+		rows, after, err := store.Iterate(ctx, "order", "", 10, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := sks(rows), []string{"B", "a", "ab", "b", "c", "é"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Iterate returned %v, expected byte-wise order %v", got, want)
+		}
+		if after != "é" {
+			t.Fatalf("Unexpected after token %q", after)
+		}
+		rows, after, err = store.Iterate(ctx, "order", "ab", 2, true)
+		if err != nil || !reflect.DeepEqual(sks(rows), []string{"b", "c"}) || after != "c" {
+			t.Fatalf("Unexpected Iterate after page %v %q %v", sks(rows), after, err)
+		}
+		rows, after, err = store.Iterate(ctx, "order", "ab", 1, false)
+		if err != nil || !reflect.DeepEqual(sks(rows), []string{"ab"}) || after != "ab" {
+			t.Fatalf("Unexpected Iterate from page %v %q %v", sks(rows), after, err)
+		}
+
+		rows, _, err = store.Query(ctx, "order", greener.KVQuery{BeginsWith: "a"})
+		if err != nil || !reflect.DeepEqual(sks(rows), []string{"a", "ab"}) {
+			t.Fatalf("Unexpected BeginsWith result %v %v", sks(rows), err)
+		}
+		var pages [][]string
+		var cursor greener.KVCursor
+		for {
+			rows, cursor, err = store.Query(ctx, "order", greener.KVQuery{Start: "a", End: "c", Reverse: true, Limit: 2, Cursor: cursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages = append(pages, sks(rows))
+			if cursor == "" {
+				break
+			}
+		}
+		if want := [][]string{{"c", "b"}, {"ab", "a"}}; !reflect.DeepEqual(pages, want) {
+			t.Fatalf("Reverse pages were %v, expected %v", pages, want)
+		}
+		if _, _, err := store.Query(ctx, "order", greener.KVQuery{Cursor: "not a cursor"}); !errors.Is(err, greener.ErrInvalidCursor) {
+			t.Fatalf("Expected ErrInvalidCursor, got %v", err)
+		}
+	})
+
+	t.Run("Increment and Patch", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(Errorf func(format string, args ...interface{})) {
+				defer wg.Done()
+				if _, err := store.Increment(ctx, "counters", "c", "n", 2); err != nil {
+					Errorf("Increment failed: %v", err)
+				}
+			}(t.Errorf)
+		}
+		wg.Wait()
+		data, err := store.Increment(ctx, "counters", "c", "n", -0.5)
+		if err != nil || data["n"] != 99.5 {
+			t.Fatalf("Unexpected counter %v %v", data, err)
+		}
+		past := time.Now().Add(-time.Second)
+		if err := store.Put(ctx, "counters", "expired", greener.JSONValue{"n": 10.0, "s": "x"}, &past); err != nil {
+			t.Fatal(err)
+		}
+		data, err = store.Increment(ctx, "counters", "expired", "n", 1)
+		if err != nil || !reflect.DeepEqual(data, greener.JSONValue{"n": 1.0}) {
+			t.Fatalf("Incrementing an expired row should start again, got %v %v", data, err)
+		}
+		if err := store.Put(ctx, "counters", "text", greener.JSONValue{"s": "x"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Increment(ctx, "counters", "text", "s", 1); err == nil {
+			t.Fatalf("Expected incrementing a string to fail")
+		}
+		data, err = store.Patch(ctx, "counters", "text", greener.JSONMergePatch{"s": nil, "t": "y", "u": 1.0})
+		if err != nil || !reflect.DeepEqual(data, greener.JSONValue{"t": "y", "u": 1.0}) {
+			t.Fatalf("Unexpected Patch result %v %v", data, err)
+		}
+		if _, err := store.Patch(ctx, "counters", "expired-missing", greener.JSONMergePatch{"t": "y"}); !errors.Is(err, greener.ErrKVNotFound) {
+			t.Fatalf("Expected ErrKVNotFound patching a missing row, got %v", err)
+		}
+	})
+}
+
+func TestKvStoreConformance(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+
+	implementations := map[string]func(t *testing.T) greener.KvStore{
+		"KV": func(t *testing.T) greener.KvStore {
+			kv, err := greener.NewKV(ctx, newTestBatchDB(t, "kvstore"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return kv
+		},
+		"MemoryKV": func(t *testing.T) greener.KvStore {
+			return greener.NewMemoryKV()
+		},
+	}
+	for name, newStore := range implementations {
+		newStore := newStore
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			testKvStoreConformance(t, ctx, newStore(t))
+		})
+	}
+}
+
+func ExampleMemoryKV() {
+	ctx := context.Background()
+	var store greener.KvStore = greener.NewMemoryKV()
+	store.Put(ctx, "settings", "theme", greener.JSONValue{"colour": "green"}, nil)
+	data, _, _ := store.Get(ctx, "settings", "theme")
+	fmt.Println(data["colour"])
+	// Output: green
+}
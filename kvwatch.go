@@ -0,0 +1,162 @@
+package greener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KVEventType describes the kind of change a KVEvent represents.
+type KVEventType string
+
+const (
+	// KVEventPut is sent when a row is created or updated, including by Increment and Patch.
+	KVEventPut KVEventType = "put"
+	// KVEventDelete is sent when a row is removed with Delete.
+	KVEventDelete KVEventType = "delete"
+	// KVEventExpire is sent when DeleteExpired or StartExpiry removes an expired row.
+	KVEventExpire KVEventType = "expire"
+)
+
+// KVEvent is a committed change to a row in a KV. Data is the new value for put events, nil for delete events, and for expire events, which are only sent by DeleteExpired and StartExpiry, the value that was removed. IDs increase in the order events are published, which happens after each write commits, so events from writes committed at almost the same time by different goroutines, even to the same row, can be numbered and delivered in a different order from the one they committed in. Re-read the row if the latest value matters.
+type KVEvent struct {
+	ID      uint64      `json:"id"`
+	Type    KVEventType `json:"type"`
+	PK      string      `json:"pk"`
+	SK      string      `json:"sk"`
+	Data    JSONValue   `json:"data,omitempty"`
+	Expires *time.Time  `json:"expires,omitempty"`
+}
+
+// watchBufferSize is the number of events that can be queued for a watcher before it is considered too slow and its channel is closed.
+const watchBufferSize = 256
+
+type kvWatcher struct {
+	pkPrefix string
+	events   chan KVEvent
+}
+
+// kvWatchers keeps track of the channels returned by Watch.
+type kvWatchers struct {
+	mu       sync.Mutex
+	lastID   uint64
+	watchers map[*kvWatcher]struct{}
+}
+
+func (kw *kvWatchers) add(pkPrefix string) *kvWatcher {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+	w := &kvWatcher{pkPrefix: pkPrefix, events: make(chan KVEvent, watchBufferSize)}
+	if kw.watchers == nil {
+		kw.watchers = make(map[*kvWatcher]struct{})
+	}
+	kw.watchers[w] = struct{}{}
+	return w
+}
+
+func (kw *kvWatchers) remove(w *kvWatcher) {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+	if _, ok := kw.watchers[w]; ok {
+		delete(kw.watchers, w)
+		close(w.events)
+	}
+}
+
+// publish sends events to every matching watcher. It must only be called once the changes have been committed. Watchers that can't keep up are closed rather than allowed to block writers.
+func (kw *kvWatchers) publish(events ...KVEvent) {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+	for _, event := range events {
+		kw.lastID++
+		event.ID = kw.lastID
+		for w := range kw.watchers {
+			if !strings.HasPrefix(event.PK, w.pkPrefix) {
+				continue
+			}
+			select {
+			case w.events <- event:
+			default:
+				delete(kw.watchers, w)
+				close(w.events)
+			}
+		}
+	}
+}
+
+// Watch returns a channel of committed changes to rows whose pk starts with pkPrefix. Use "" to watch everything. The channel is closed when ctx is done, or if the receiver falls too far behind, in which case it should call Watch again and re-read any state it needs.
+func (tm *KV) Watch(ctx context.Context, pkPrefix string) <-chan KVEvent {
+	w := tm.watchers.add(pkPrefix)
+	go func() {
+		<-ctx.Done()
+		tm.watchers.remove(w)
+	}()
+	return w.events
+}
+
+// KVEventHandler streams KV changes to browsers as Server-Sent Events.
+type KVEventHandler struct {
+	kv        *KV
+	pkPrefix  func(*http.Request) (string, error)
+	keepAlive time.Duration
+}
+
+// NewKVEventHandler creates a KVEventHandler. The pkPrefix function decides which partitions a request may watch. If it returns an error the request is rejected with 403 Forbidden.
+func NewKVEventHandler(kv *KV, pkPrefix func(*http.Request) (string, error)) *KVEventHandler {
+	return &KVEventHandler{kv: kv, pkPrefix: pkPrefix, keepAlive: 30 * time.Second}
+}
+
+// ServeHTTP writes each event as an SSE message with the event ID as the id, the event type as the event name and the JSON encoded event as the data.
+func (h *KVEventHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	prefix, err := h.pkPrefix(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	events := h.kv.Watch(ctx, prefix)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(h.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// A comment line stops proxies closing an idle connection
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				// We fell behind, so end the stream and let the browser's EventSource reconnect
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package greener_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func nextEvent(t *testing.T, events <-chan greener.KVEvent) greener.KVEvent {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("Event channel closed unexpectedly")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for an event")
+	}
+	return greener.KVEvent{}
+}
+
+func TestKVWatch(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	db := newTestBatchDB(t, "kvwatch")
+	kv, err := greener.NewKV(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Committed changes are sent to matching watchers", func(t *testing.T) {
+		watchCtx, stop := context.WithCancel(ctx)
+		events := kv.Watch(watchCtx, "watched/")
+
+		if err := kv.Put(ctx, "ignored/1", "a", greener.JSONValue{"n": 1.0}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := kv.Put(ctx, "watched/1", "a", greener.JSONValue{"n": 1.0}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := kv.Increment(ctx, "watched/1", "a", "n", 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := kv.Delete(ctx, "watched/1", "a"); err != nil {
+			t.Fatal(err)
+		}
+		// Deleting a missing row doesn't change anything so no event is sent
+		if err := kv.Delete(ctx, "watched/1", "a"); err != nil {
+			t.Fatal(err)
+		}
+
+		event := nextEvent(t, events)
+		if event.Type != greener.KVEventPut || event.PK != "watched/1" || event.Data["n"] != 1.0 {
+			t.Fatalf("Unexpected first event: %+v", event)
+		}
+		event = nextEvent(t, events)
+		if event.Type != greener.KVEventPut || event.Data["n"] != 2.0 {
+			t.Fatalf("Unexpected second event: %+v", event)
+		}
+		event = nextEvent(t, events)
+		if event.Type != greener.KVEventDelete || event.SK != "a" {
+			t.Fatalf("Unexpected third event: %+v", event)
+		}
+
+		stop()
+		for range events {
+			// Drain until the channel is closed
+		}
+	})
+
+	t.Run("Rolled back changes are not sent", func(t *testing.T) {
+		watchCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		events := kv.Watch(watchCtx, "rollback/")
+
+		// A failing write from another goroutine in the same batch aborts the transaction the Put shares
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			db.Write(func(writeDB greener.WriteDBHandler) error {
+				return errors.New("abort the batch")
+			})
+		}()
+		kv.Put(ctx, "rollback/1", "a", greener.JSONValue{"n": 1.0}, nil)
+		<-done
+
+		if err := kv.Put(ctx, "rollback/2", "b", greener.JSONValue{"n": 2.0}, nil); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			event := nextEvent(t, events)
+			if event.PK == "rollback/2" {
+				break
+			}
+			data, _, err := kv.Get(ctx, event.PK, event.SK)
+			if err != nil || data["n"] != 1.0 {
+				t.Fatalf("Received an event for a change that wasn't committed: %+v", event)
+			}
+		}
+	})
+
+	t.Run("Server-Sent Events handler", func(t *testing.T) {
+		handler := greener.NewKVEventHandler(kv, func(r *http.Request) (string, error) {
+			if r.URL.Query().Get("pk") == "" {
+				return "", errors.New("no pk specified")
+			}
+			return r.URL.Query().Get("pk"), nil
+		})
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected 403, got %d", resp.StatusCode)
+		}
+
+		reqCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		req, _ := http.NewRequestWithContext(reqCtx, "GET", server.URL+"?pk=sse/", nil)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Unexpected content type %s", ct)
+		}
+		if err := kv.Put(ctx, "sse/1", "a", greener.JSONValue{"hello": "world"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(resp.Body)
+		var eventName, data string
+		for data == "" {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, "event: ") {
+				eventName = strings.TrimSpace(strings.TrimPrefix(line, "event: "))
+			}
+			if strings.HasPrefix(line, "data: ") {
+				data = strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+			}
+		}
+		var event greener.KVEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatal(err)
+		}
+		if eventName != "put" || event.PK != "sse/1" || event.Data["hello"] != "world" {
+			t.Fatalf("Unexpected event %s: %+v", eventName, event)
+		}
+	})
+}
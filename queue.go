@@ -0,0 +1,487 @@
+package greener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// JobState is where a job is in its life cycle.
+type JobState string
+
+const (
+	// JobReady jobs are waiting for their run-at time to arrive and a worker to claim them.
+	JobReady JobState = "ready"
+	// JobRunning jobs have been claimed by a worker. If the worker doesn't finish before the visibility timeout, the job is claimed again.
+	JobRunning JobState = "running"
+	// JobDone jobs finished successfully.
+	JobDone JobState = "done"
+	// JobDead jobs failed on every attempt and won't be run again unless Retry is called.
+	JobDead JobState = "dead"
+)
+
+// ErrJobNotFound is returned when there is no job with the given ID.
+var ErrJobNotFound = errors.New("job not found")
+
+// Job is one unit of work in a Queue.
+type Job struct {
+	ID          int64
+	Queue       string
+	Payload     JSONValue
+	State       JobState
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time
+	LastError   string
+	Created     time.Time
+	Updated     time.Time
+}
+
+// EnqueueOptions controls when and how often a job runs.
+type EnqueueOptions struct {
+	// RunAt delays the job until this time. The zero value runs it as soon as possible.
+	RunAt time.Time
+	// MaxAttempts is the number of times the job is tried before it is dead-lettered. Defaults to 5.
+	MaxAttempts int
+}
+
+// JobHandler does the work for a job. Returning an error schedules a retry, or dead-letters the job if it has run out of attempts. The context is cancelled when the visibility timeout runs out, since another worker may then claim the job.
+type JobHandler func(ctx context.Context, job Job) error
+
+// WorkerOptions configures Work.
+type WorkerOptions struct {
+	// Concurrency is the number of jobs run at once. Defaults to 1.
+	Concurrency int
+	// PollInterval is how often to look for jobs when the queue is empty. Jobs enqueued with Enqueue in the same process are picked up straight away. Defaults to 1 second.
+	PollInterval time.Duration
+	// VisibilityTimeout is how long a worker has to finish a job before it is assumed to have crashed and the job is run again. Defaults to 5 minutes.
+	VisibilityTimeout time.Duration
+	// Backoff returns the delay before the given attempt is retried. Defaults to 2^(attempt-1) seconds, capped at an hour.
+	Backoff func(attempt int) time.Duration
+	// Logger receives errors from the workers. Defaults to the standard library log package.
+	Logger Logger
+}
+
+func (o WorkerOptions) withDefaults() WorkerOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = time.Second
+	}
+	if o.VisibilityTimeout <= 0 {
+		o.VisibilityTimeout = 5 * time.Minute
+	}
+	if o.Backoff == nil {
+		o.Backoff = DefaultJobBackoff
+	}
+	if o.Logger == nil {
+		o.Logger = NewDefaultLogger(log.Printf)
+	}
+	return o
+}
+
+// DefaultJobBackoff waits 1, 2, 4, 8... seconds between attempts, up to an hour.
+func DefaultJobBackoff(attempt int) time.Duration {
+	if attempt > 12 {
+		return time.Hour
+	}
+	delay := time.Duration(math.Pow(2, float64(attempt-1))) * time.Second
+	if delay > time.Hour {
+		return time.Hour
+	}
+	return delay
+}
+
+// Queue is a durable job queue stored in a table of a BatchDB. Jobs can be enqueued in the same transaction as the data they relate to with EnqueueTx, so a job is only ever seen if that data was committed. Each claim, completion and failure is its own write. Delivery is at least once: if a worker crashes, or is still running a job when its visibility timeout runs out, another worker claims the job and runs it again, so handlers should be idempotent. Completions are fenced by the attempt number, so when a slow worker does finish, its outcome is discarded rather than overwriting that of the attempt that replaced it.
+type Queue struct {
+	db    DB
+	table string
+	mu    sync.Mutex
+	// wakeups has a channel for each named queue with Work loops waiting on it, which wake closes to wake them all
+	wakeups map[string]chan struct{}
+}
+
+// NewQueue initializes and returns a Queue stored in the default "jobs" table.
+func NewQueue(ctx context.Context, db DB) (*Queue, error) {
+	return NewQueueTable(ctx, db, "jobs")
+}
+
+// NewQueueTable initializes and returns a Queue stored in the named table. Within a table, jobs are separated into named queues, so most applications only need one table.
+func NewQueueTable(ctx context.Context, db DB, name string) (*Queue, error) {
+	if err := ValidateKVTableName(name); err != nil {
+		return nil, err
+	}
+	q := &Queue{db: db, table: name, wakeups: make(map[string]chan struct{})}
+	queries := []string{
+		fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+		    id INTEGER PRIMARY KEY AUTOINCREMENT,
+		    queue TEXT NOT NULL,
+		    payload JSON NOT NULL,
+		    state TEXT NOT NULL,
+		    attempts INTEGER NOT NULL DEFAULT 0,
+		    max_attempts INTEGER NOT NULL,
+		    run_at REAL NOT NULL,
+		    locked_until REAL,
+		    last_error TEXT NOT NULL DEFAULT '',
+		    created REAL NOT NULL,
+		    updated REAL NOT NULL
+		);`, name),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_claim ON %s (queue, state, run_at);`, name, name),
+	}
+	err := db.Write(func(writeDB WriteDBHandler) error {
+		for _, query := range queries {
+			if _, err := writeDB.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("failed to create job table %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func timeToDB(t time.Time) float64 {
+	return float64(t.UnixMilli()) / 1000
+}
+
+func timeFromDB(seconds float64) time.Time {
+	return time.UnixMilli(int64(math.Round(seconds * 1000)))
+}
+
+// EnqueueTx adds a job to the named queue inside an existing BatchDB write, so it is committed, or discarded, along with the rest of the transaction. It returns the new job's ID.
+func (q *Queue) EnqueueTx(ctx context.Context, writeDB WriteDBHandler, queue string, payload JSONValue, opts EnqueueOptions) (int64, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding job payload to JSON: %w", err)
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	now := time.Now()
+	runAt := opts.RunAt
+	if runAt.IsZero() {
+		runAt = now
+	}
+	result, err := writeDB.ExecContext(ctx, fmt.Sprintf(`
+	    INSERT INTO %s (queue, payload, state, max_attempts, run_at, created, updated)
+	    VALUES (?, ?, ?, ?, ?, ?, ?);
+	`, q.table), queue, jsonData, JobReady, opts.MaxAttempts, timeToDB(runAt), timeToDB(now), timeToDB(now))
+	if err != nil {
+		return 0, fmt.Errorf("failed to enqueue job: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+// Enqueue adds a job to the named queue in its own write and returns its ID once it has been committed.
+func (q *Queue) Enqueue(ctx context.Context, queue string, payload JSONValue, opts EnqueueOptions) (int64, error) {
+	var id int64
+	err := q.db.Write(func(writeDB WriteDBHandler) error {
+		var err error
+		id, err = q.EnqueueTx(ctx, writeDB, queue, payload, opts)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	q.wake(queue)
+	return id, nil
+}
+
+// wakeup returns a channel that is closed the next time wake is called for the named queue.
+func (q *Queue) wakeup(queue string) <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ch, ok := q.wakeups[queue]
+	if !ok {
+		ch = make(chan struct{})
+		q.wakeups[queue] = ch
+	}
+	return ch
+}
+
+// wake tells every Work loop for the named queue in this process to look for jobs now rather than waiting for the next poll.
+func (q *Queue) wake(queue string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ch, ok := q.wakeups[queue]; ok {
+		close(ch)
+		delete(q.wakeups, queue)
+	}
+}
+
+const jobColumns = "id, queue, payload, state, attempts, max_attempts, run_at, last_error, created, updated"
+
+type jobScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row jobScanner) (Job, error) {
+	var job Job
+	var payload string
+	var runAt, created, updated float64
+	if err := row.Scan(&job.ID, &job.Queue, &payload, &job.State, &job.Attempts, &job.MaxAttempts, &runAt, &job.LastError, &created, &updated); err != nil {
+		return job, fmt.Errorf("error scanning job: %w", err)
+	}
+	if err := json.Unmarshal([]byte(payload), &job.Payload); err != nil {
+		return job, fmt.Errorf("error decoding job payload from JSON: %w", err)
+	}
+	job.RunAt = timeFromDB(runAt)
+	job.Created = timeFromDB(created)
+	job.Updated = timeFromDB(updated)
+	return job, nil
+}
+
+// claim marks up to limit jobs that are due, or whose visibility timeout has run out, as running, and returns them.
+func (q *Queue) claim(ctx context.Context, queue string, limit int, visibility time.Duration) ([]Job, error) {
+	var jobs []Job
+	err := q.db.Write(func(writeDB WriteDBHandler) error {
+		jobs = jobs[:0]
+		now := time.Now()
+		rows, err := writeDB.QueryContext(ctx, fmt.Sprintf(`
+		    UPDATE %s SET state = ?, attempts = attempts + 1, locked_until = ?, updated = ?
+		    WHERE id IN (
+		        SELECT id FROM %s
+		        WHERE queue = ? AND ((state = ? AND run_at <= ?) OR (state = ? AND locked_until <= ?))
+		        ORDER BY run_at, id
+		        LIMIT ?
+		    )
+		    RETURNING %s;
+		`, q.table, q.table, jobColumns), JobRunning, timeToDB(now.Add(visibility)), timeToDB(now), queue, JobReady, timeToDB(now), JobRunning, timeToDB(now), limit)
+		if err != nil {
+			return fmt.Errorf("failed to claim jobs: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			job, err := scanJob(rows)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+		}
+		return rows.Err()
+	})
+	return jobs, err
+}
+
+// finish records the outcome of an attempt. It does nothing if the job has since been claimed by another worker, which the attempt number reveals.
+func (q *Queue) finish(ctx context.Context, job Job, handlerErr error, retryAt time.Time, countAttempt bool) error {
+	now := timeToDB(time.Now())
+	var query string
+	var args []interface{}
+	switch {
+	case handlerErr == nil:
+		query = "UPDATE %s SET state = ?, locked_until = NULL, last_error = '', updated = ? WHERE id = ? AND state = ? AND attempts = ?"
+		args = []interface{}{JobDone, now}
+	case !countAttempt:
+		query = "UPDATE %s SET state = ?, attempts = attempts - 1, locked_until = NULL, updated = ? WHERE id = ? AND state = ? AND attempts = ?"
+		args = []interface{}{JobReady, now}
+	case job.Attempts >= job.MaxAttempts:
+		query = "UPDATE %s SET state = ?, locked_until = NULL, last_error = ?, updated = ? WHERE id = ? AND state = ? AND attempts = ?"
+		args = []interface{}{JobDead, handlerErr.Error(), now}
+	default:
+		query = "UPDATE %s SET state = ?, run_at = ?, locked_until = NULL, last_error = ?, updated = ? WHERE id = ? AND state = ? AND attempts = ?"
+		args = []interface{}{JobReady, timeToDB(retryAt), handlerErr.Error(), now}
+	}
+	args = append(args, job.ID, JobRunning, job.Attempts)
+	return q.db.Write(func(writeDB WriteDBHandler) error {
+		if _, err := writeDB.ExecContext(ctx, fmt.Sprintf(query, q.table), args...); err != nil {
+			return fmt.Errorf("failed to update job %d: %w", job.ID, err)
+		}
+		return nil
+	})
+}
+
+// run calls the handler for one job, turning a panic into an error so that one bad job can't stop the worker.
+func (q *Queue) run(ctx context.Context, handler JobHandler, job Job, visibility time.Duration) (err error) {
+	jobCtx, cancel := context.WithTimeout(ctx, visibility)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(jobCtx, job)
+}
+
+// Work claims and runs jobs from the named queue until ctx is done, then waits for the jobs in progress to finish before returning. Run it in its own goroutine. Jobs interrupted by ctx being cancelled are put back without using up an attempt.
+func (q *Queue) Work(ctx context.Context, queue string, handler JobHandler, opts WorkerOptions) {
+	opts = opts.withDefaults()
+	// The outcome of a job is recorded even after ctx is done, so that finished work isn't repeated
+	finishCtx := context.Background()
+	slots := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		// Taken before claiming, so a job enqueued while claiming still wakes the loop
+		wakeup := q.wakeup(queue)
+		free := opts.Concurrency - len(slots)
+		if free > 0 {
+			jobs, err := q.claim(ctx, queue, free, opts.VisibilityTimeout)
+			if err != nil && ctx.Err() == nil {
+				opts.Logger.Logf("Error claiming jobs from queue %s: %v", queue, err)
+			}
+			for _, job := range jobs {
+				slots <- struct{}{}
+				wg.Add(1)
+				go func(job Job) {
+					defer func() {
+						<-slots
+						wg.Done()
+						q.wake(queue)
+					}()
+					if job.Attempts > job.MaxAttempts {
+						// A worker crashed or timed out on the final attempt
+						if err := q.finish(finishCtx, job, errors.New("visibility timeout exceeded on final attempt"), time.Time{}, true); err != nil {
+							opts.Logger.Logf("Error dead-lettering job %d: %v", job.ID, err)
+						}
+						return
+					}
+					err := q.run(ctx, handler, job, opts.VisibilityTimeout)
+					interrupted := err != nil && ctx.Err() != nil
+					if err := q.finish(finishCtx, job, err, time.Now().Add(opts.Backoff(job.Attempts)), !interrupted); err != nil {
+						opts.Logger.Logf("Error recording result of job %d: %v", job.ID, err)
+					}
+				}(job)
+			}
+		}
+		// Look again when a job is enqueued or finishes, or at the next poll
+		select {
+		case <-ctx.Done():
+			return
+		case <-wakeup:
+		case <-ticker.C:
+		}
+	}
+}
+
+// JobStats counts the jobs in a queue by state. Scheduled counts ready jobs whose run-at time is still in the future.
+type JobStats struct {
+	Ready     int
+	Scheduled int
+	Running   int
+	Done      int
+	Dead      int
+}
+
+// Stats returns the number of jobs in each state in the named queue.
+func (q *Queue) Stats(ctx context.Context, queue string) (JobStats, error) {
+	var stats JobStats
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(`
+	    SELECT state, run_at > ?, COUNT(*) FROM %s WHERE queue = ? GROUP BY 1, 2;
+	`, q.table), timeToDB(time.Now()), queue)
+	if err != nil {
+		return stats, fmt.Errorf("error querying job stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var state JobState
+		var future bool
+		var count int
+		if err := rows.Scan(&state, &future, &count); err != nil {
+			return stats, fmt.Errorf("error scanning job stats: %w", err)
+		}
+		switch {
+		case state == JobReady && future:
+			stats.Scheduled += count
+		case state == JobReady:
+			stats.Ready += count
+		case state == JobRunning:
+			stats.Running += count
+		case state == JobDone:
+			stats.Done += count
+		case state == JobDead:
+			stats.Dead += count
+		}
+	}
+	return stats, rows.Err()
+}
+
+// List returns up to limit jobs in the named queue with the given state, oldest first, starting after the job with ID afterID. Pass 0 to start at the beginning.
+func (q *Queue) List(ctx context.Context, queue string, state JobState, afterID int64, limit int) ([]Job, error) {
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(`
+	    SELECT %s FROM %s WHERE queue = ? AND state = ? AND id > ? ORDER BY id LIMIT ?;
+	`, jobColumns, q.table), queue, state, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing jobs: %w", err)
+	}
+	defer rows.Close()
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Get returns the job with the given ID, or ErrJobNotFound.
+func (q *Queue) Get(ctx context.Context, id int64) (Job, error) {
+	job, err := scanJob(q.db.QueryRowContext(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE id = ?;", jobColumns, q.table), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return job, ErrJobNotFound
+	}
+	return job, err
+}
+
+// Retry puts a dead job back in its queue with a fresh set of attempts. It returns ErrJobNotFound if there is no dead job with that ID.
+func (q *Queue) Retry(ctx context.Context, id int64) error {
+	var queue string
+	updated := false
+	now := timeToDB(time.Now())
+	err := q.db.Write(func(writeDB WriteDBHandler) error {
+		rows, err := writeDB.QueryContext(ctx, fmt.Sprintf(`
+		    UPDATE %s SET state = ?, attempts = 0, run_at = ?, updated = ? WHERE id = ? AND state = ?
+		    RETURNING queue;
+		`, q.table), JobReady, now, now, id, JobDead)
+		if err != nil {
+			return fmt.Errorf("failed to retry job %d: %w", id, err)
+		}
+		defer rows.Close()
+		updated = rows.Next()
+		if updated {
+			if err := rows.Scan(&queue); err != nil {
+				return fmt.Errorf("error scanning retried job %d: %w", id, err)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return rows.Close()
+	})
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return ErrJobNotFound
+	}
+	q.wake(queue)
+	return nil
+}
+
+// PurgeDone deletes jobs in the named queue that finished before the given time, and returns how many were removed.
+func (q *Queue) PurgeDone(ctx context.Context, queue string, before time.Time) (int, error) {
+	var deleted int64
+	err := q.db.Write(func(writeDB WriteDBHandler) error {
+		result, err := writeDB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE queue = ? AND state = ? AND updated < ?;", q.table), queue, JobDone, timeToDB(before))
+		if err != nil {
+			return fmt.Errorf("failed to purge jobs: %w", err)
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	return int(deleted), err
+}
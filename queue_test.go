@@ -0,0 +1,269 @@
+package greener_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	db := newTestBatchDB(t, "queue")
+	q, err := greener.NewQueue(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastRetry := func(attempt int) time.Duration { return 10 * time.Millisecond }
+
+	t.Run("EnqueueTx commits with the transaction", func(t *testing.T) {
+		err := db.Write(func(writeDB greener.WriteDBHandler) error {
+			if _, err := q.EnqueueTx(ctx, writeDB, "tx", greener.JSONValue{"n": 1.0}, greener.EnqueueOptions{}); err != nil {
+				return err
+			}
+			return errors.New("abort")
+		})
+		if err == nil {
+			t.Fatalf("Expected the write to be aborted")
+		}
+		stats, err := q.Stats(ctx, "tx")
+		if err != nil || stats != (greener.JobStats{}) {
+			t.Fatalf("Expected no jobs after the abort, got %+v %v", stats, err)
+		}
+		err = db.Write(func(writeDB greener.WriteDBHandler) error {
+			_, err := q.EnqueueTx(ctx, writeDB, "tx", greener.JSONValue{"n": 2.0}, greener.EnqueueOptions{})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err = q.Stats(ctx, "tx")
+		if err != nil || stats.Ready != 1 {
+			t.Fatalf("Expected one ready job, got %+v %v", stats, err)
+		}
+	})
+
+	t.Run("Workers run jobs with limited concurrency", func(t *testing.T) {
+		var mu sync.Mutex
+		seen := map[float64]int{}
+		running, maxRunning := 0, 0
+		for i := 0; i < 20; i++ {
+			if _, err := q.Enqueue(ctx, "work", greener.JSONValue{"n": float64(i)}, greener.EnqueueOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		workCtx, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			q.Work(workCtx, "work", func(ctx context.Context, job greener.Job) error {
+				mu.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				seen[job.Payload["n"].(float64)]++
+				mu.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			}, greener.WorkerOptions{Concurrency: 3, PollInterval: 10 * time.Millisecond})
+			close(done)
+		}()
+		waitFor(t, "jobs to finish", func() bool {
+			stats, err := q.Stats(ctx, "work")
+			return err == nil && stats.Done == 20
+		})
+		stop()
+		<-done
+		mu.Lock()
+		defer mu.Unlock()
+		if len(seen) != 20 || maxRunning > 3 {
+			t.Fatalf("Unexpected run: %d distinct jobs, %d at once", len(seen), maxRunning)
+		}
+		for n, count := range seen {
+			if count != 1 {
+				t.Fatalf("Job %v ran %d times", n, count)
+			}
+		}
+	})
+
+	t.Run("Retries, dead letters and Retry", func(t *testing.T) {
+		id, err := q.Enqueue(ctx, "failing", greener.JSONValue{}, greener.EnqueueOptions{MaxAttempts: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		attempts := 0
+		workCtx, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			q.Work(workCtx, "failing", func(ctx context.Context, job greener.Job) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				if attempts == 4 {
+					return nil
+				}
+				if attempts == 2 {
+					panic("boom")
+				}
+				return errors.New("failed")
+			}, greener.WorkerOptions{PollInterval: 5 * time.Millisecond, Backoff: fastRetry})
+			close(done)
+		}()
+		waitFor(t, "job to be dead-lettered", func() bool {
+			job, err := q.Get(ctx, id)
+			return err == nil && job.State == greener.JobDead
+		})
+		job, _ := q.Get(ctx, id)
+		if job.Attempts != 3 || job.LastError != "failed" {
+			t.Fatalf("Unexpected dead job %+v", job)
+		}
+		dead, err := q.List(ctx, "failing", greener.JobDead, 0, 10)
+		if err != nil || len(dead) != 1 || dead[0].ID != id {
+			t.Fatalf("Unexpected dead letter list %+v %v", dead, err)
+		}
+		if err := q.Retry(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "retried job to finish", func() bool {
+			job, err := q.Get(ctx, id)
+			return err == nil && job.State == greener.JobDone
+		})
+		stop()
+		<-done
+		if err := q.Retry(ctx, id); !errors.Is(err, greener.ErrJobNotFound) {
+			t.Fatalf("Expected ErrJobNotFound retrying a finished job, got %v", err)
+		}
+		if _, err := q.Get(ctx, 999999); !errors.Is(err, greener.ErrJobNotFound) {
+			t.Fatalf("Expected ErrJobNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Scheduled jobs, visibility timeout and restarts", func(t *testing.T) {
+		runAt := time.Now().Add(100 * time.Millisecond)
+		id, err := q.Enqueue(ctx, "scheduled", greener.JSONValue{}, greener.EnqueueOptions{RunAt: runAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := q.Stats(ctx, "scheduled")
+		if err != nil || stats.Scheduled != 1 {
+			t.Fatalf("Expected a scheduled job, got %+v %v", stats, err)
+		}
+
+		// The first worker hangs until its visibility timeout runs out, as if it had crashed
+		var mu sync.Mutex
+		var started []time.Time
+		var attempts []int
+		workCtx, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			q.Work(workCtx, "scheduled", func(ctx context.Context, job greener.Job) error {
+				mu.Lock()
+				started = append(started, time.Now())
+				attempts = append(attempts, job.Attempts)
+				first := len(started) == 1
+				mu.Unlock()
+				if first {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				return nil
+			}, greener.WorkerOptions{PollInterval: 5 * time.Millisecond, VisibilityTimeout: 50 * time.Millisecond, Backoff: fastRetry})
+			close(done)
+		}()
+		waitFor(t, "scheduled job to finish", func() bool {
+			job, err := q.Get(ctx, id)
+			return err == nil && job.State == greener.JobDone
+		})
+		stop()
+		<-done
+		mu.Lock()
+		if started[0].Before(runAt) || len(attempts) != 2 || attempts[1] != 2 {
+			t.Fatalf("Unexpected runs %v %v", started, attempts)
+		}
+		mu.Unlock()
+
+		// Jobs left by a process that stopped are picked up by a new Queue on the same database
+		if _, err := q.Enqueue(ctx, "restart", greener.JSONValue{}, greener.EnqueueOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		restarted, err := greener.NewQueue(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		workCtx, stop = context.WithCancel(ctx)
+		done = make(chan struct{})
+		go func() {
+			restarted.Work(workCtx, "restart", func(ctx context.Context, job greener.Job) error { return nil }, greener.WorkerOptions{PollInterval: 5 * time.Millisecond})
+			close(done)
+		}()
+		waitFor(t, "job to run after restart", func() bool {
+			stats, err := q.Stats(ctx, "restart")
+			return err == nil && stats.Done == 1
+		})
+		stop()
+		<-done
+		purged, err := q.PurgeDone(ctx, "restart", time.Now().Add(time.Second))
+		if err != nil || purged != 1 {
+			t.Fatalf("Expected to purge one job, got %d %v", purged, err)
+		}
+	})
+
+	t.Run("Enqueue wakes the workers for its own queue", func(t *testing.T) {
+		var mu sync.Mutex
+		ran := map[string]int{}
+		workCtx, stop := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		// With an hour between polls, jobs only run promptly if Enqueue wakes a worker for the right queue
+		for _, queue := range []string{"wake-a", "wake-a", "wake-b"} {
+			wg.Add(1)
+			go func(queue string) {
+				defer wg.Done()
+				q.Work(workCtx, queue, func(ctx context.Context, job greener.Job) error {
+					mu.Lock()
+					ran[queue]++
+					mu.Unlock()
+					return nil
+				}, greener.WorkerOptions{PollInterval: time.Hour})
+			}(queue)
+		}
+		for i := 0; i < 10; i++ {
+			queue := []string{"wake-a", "wake-b"}[i%2]
+			if _, err := q.Enqueue(ctx, queue, greener.JSONValue{"n": float64(i)}, greener.EnqueueOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the job in "+queue+" to run", func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return ran["wake-a"]+ran["wake-b"] == i+1
+			})
+		}
+		stop()
+		wg.Wait()
+		if ran["wake-a"] != 5 || ran["wake-b"] != 5 {
+			t.Fatalf("Unexpected runs %v", ran)
+		}
+	})
+}
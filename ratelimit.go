@@ -0,0 +1,231 @@
+package greener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit describes a token bucket: each key can make Burst requests at once, and the bucket refills at Rate requests per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// validate checks the bucket refills and can hold at least one request, since a zero Rate would make every wait infinitely long.
+func (l RateLimit) validate() error {
+	if !(l.Rate > 0) || math.IsInf(l.Rate, 1) {
+		return fmt.Errorf("rate limit rate must be a positive number of requests per second, got %v", l.Rate)
+	}
+	if l.Burst < 1 {
+		return fmt.Errorf("rate limit burst must be at least 1, got %d", l.Burst)
+	}
+	return nil
+}
+
+// fullAfter returns how long a bucket holding tokens takes to refill completely.
+func (l RateLimit) fullAfter(tokens float64) time.Duration {
+	return time.Duration((float64(l.Burst) - tokens) / l.Rate * float64(time.Second))
+}
+
+// take refills a bucket that last held tokens at updated, then takes one token if there is one. It returns the tokens left and, if the request isn't allowed, how long until it would be.
+func (l RateLimit) take(tokens float64, updated, now time.Time) (float64, time.Duration, bool) {
+	if elapsed := now.Sub(updated).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(l.Burst), tokens+elapsed*l.Rate)
+	}
+	if tokens >= 1 {
+		return tokens - 1, 0, true
+	}
+	return tokens, time.Duration((1 - tokens) / l.Rate * float64(time.Second)), false
+}
+
+// RateLimiterStore keeps the token buckets for a RateLimiter. Allow takes a token from the bucket for key, reporting whether the request may go ahead and, if not, how long to wait.
+type RateLimiterStore interface {
+	Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryRateLimiterStore keeps buckets in memory, so it only limits requests made to a single process.
+type MemoryRateLimiterStore struct {
+	mu        sync.Mutex
+	buckets   map[string]memoryBucket
+	lastSweep time.Time
+}
+
+var _ RateLimiterStore = (*MemoryRateLimiterStore)(nil)
+
+// NewMemoryRateLimiterStore creates an empty MemoryRateLimiterStore.
+func NewMemoryRateLimiterStore() *MemoryRateLimiterStore {
+	return &MemoryRateLimiterStore{buckets: make(map[string]memoryBucket), lastSweep: time.Now()}
+}
+
+func (s *MemoryRateLimiterStore) Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	if err := limit.validate(); err != nil {
+		return false, 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	// Full buckets behave the same as missing ones, so forget them once a minute to stop the map growing forever
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = memoryBucket{tokens: float64(limit.Burst), updated: now}
+	}
+	tokens, retryAfter, allowed := limit.take(b.tokens, b.updated, now)
+	if allowed {
+		s.buckets[key] = memoryBucket{tokens: tokens, updated: now, full: now.Add(limit.fullAfter(tokens))}
+	}
+	return allowed, retryAfter, nil
+}
+
+// KVRateLimiterStore keeps buckets as rows in a KV partition, so processes sharing a database file share their limits. Each row expires once its bucket would be full again, so the expiry routine removes idle keys.
+type KVRateLimiterStore struct {
+	kv        *KV
+	partition string
+}
+
+var _ RateLimiterStore = (*KVRateLimiterStore)(nil)
+
+// NewKVRateLimiterStore creates a KVRateLimiterStore that stores buckets in the given partition of kv.
+func NewKVRateLimiterStore(kv *KV, partition string) *KVRateLimiterStore {
+	return &KVRateLimiterStore{kv: kv, partition: partition}
+}
+
+// Allow reads and updates the bucket in a single BatchDB write, so concurrent requests can't spend the same token. Rejected requests don't write anything.
+func (s *KVRateLimiterStore) Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	if err := limit.validate(); err != nil {
+		return false, 0, err
+	}
+	tableName := s.kv.table
+	var allowed bool
+	var retryAfter time.Duration
+	var data JSONValue
+	var expires time.Time
+	err := s.kv.db.Write(func(writeDB WriteDBHandler) error {
+		now := time.Now()
+		tokens, updated := float64(limit.Burst), now
+		rows, err := writeDB.QueryContext(ctx, fmt.Sprintf(`
+		    SELECT json_extract(data, '$.tokens'), json_extract(data, '$.updated') FROM %s
+		    WHERE pk = ? AND sk = ? AND (expires IS NULL OR expires > ?);
+		`, tableName), s.partition, key, kvNow())
+		if err != nil {
+			return fmt.Errorf("error querying for rate limit bucket: %w", err)
+		}
+		if rows.Next() {
+			var updatedMilli int64
+			if err := rows.Scan(&tokens, &updatedMilli); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning rate limit bucket: %w", err)
+			}
+			updated = time.UnixMilli(updatedMilli)
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		tokens, retryAfter, allowed = limit.take(tokens, updated, now)
+		if !allowed {
+			return nil
+		}
+		data = JSONValue{"tokens": tokens, "updated": float64(now.UnixMilli())}
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("error encoding rate limit bucket to JSON: %w", err)
+		}
+		expires = now.Add(limit.fullAfter(tokens))
+		_, err = writeDB.ExecContext(ctx, fmt.Sprintf(`
+		    INSERT INTO %s (pk, sk, data, expires) VALUES (?, ?, ?, ?)
+		    ON CONFLICT(pk, sk) DO UPDATE SET data=excluded.data, expires=excluded.expires;
+		`, tableName), s.partition, key, jsonData, expiresToDB(&expires))
+		if err != nil {
+			return fmt.Errorf("failed to write rate limit bucket: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	if allowed {
+		s.kv.committed(KVEvent{Type: KVEventPut, PK: s.partition, SK: key, Data: data, Expires: &expires})
+	}
+	return allowed, retryAfter, nil
+}
+
+// RateLimitKeyFunc chooses the bucket a request counts against. Returning an empty key exempts the request from the limit.
+type RateLimitKeyFunc func(r *http.Request) (string, error)
+
+// RateLimitByIP keys requests by the IP address of the connection. Behind a reverse proxy, use a custom RateLimitKeyFunc that reads the address the proxy reports instead.
+func RateLimitByIP(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr, nil
+	}
+	return "ip:" + host, nil
+}
+
+// RateLimitByIdentity keys requests by the identity that verify returns, such as the actor a token has been checked to belong to, so each actor gets its own limit wherever it connects from. Requests for which verify returns an empty identity, including those with missing or invalid credentials, fall back to RateLimitByIP, so made-up credentials can't be used to get a fresh bucket. Verifying still costs something and an attacker with many valid identities still gets many buckets, so put a RateLimiter using RateLimitByIP in front of one using this.
+func RateLimitByIdentity(verify func(r *http.Request) string) RateLimitKeyFunc {
+	return func(r *http.Request) (string, error) {
+		identity := verify(r)
+		if identity == "" {
+			return RateLimitByIP(r)
+		}
+		return "identity:" + identity, nil
+	}
+}
+
+// RateLimiter is middleware that rejects requests over a RateLimit with 429 Too Many Requests and a Retry-After header.
+type RateLimiter struct {
+	logger Logger
+	store  RateLimiterStore
+	limit  RateLimit
+	key    RateLimitKeyFunc
+}
+
+// NewRateLimiter creates a RateLimiter, returning an error if limit has a Rate that isn't positive or a Burst less than 1. If the store fails, the error is logged and the request is allowed, so a database problem doesn't take the whole site down.
+func NewRateLimiter(logger Logger, store RateLimiterStore, limit RateLimit, key RateLimitKeyFunc) (*RateLimiter, error) {
+	if err := limit.validate(); err != nil {
+		return nil, err
+	}
+	return &RateLimiter{logger: logger, store: store, limit: limit, key: key}, nil
+}
+
+// Middleware applies the limit to every request handled by next.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := l.key(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if key != "" {
+			allowed, retryAfter, err := l.store.Allow(r.Context(), key, l.limit)
+			if err != nil {
+				l.logger.Logf("Rate limiter failed, allowing request: %v", err)
+			} else if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
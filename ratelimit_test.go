@@ -0,0 +1,114 @@
+package greener_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	kv, err := greener.NewKV(ctx, newTestBatchDB(t, "ratelimit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newStores := map[string]func(partition string) greener.RateLimiterStore{
+		"Memory": func(string) greener.RateLimiterStore { return greener.NewMemoryRateLimiterStore() },
+		"KV":     func(partition string) greener.RateLimiterStore { return greener.NewKVRateLimiterStore(kv, partition) },
+	}
+	tokens := map[string]string{"alice-token": "alice", "bob-token": "bob", "carol-token": "carol", "dave-token": "dave"}
+	verify := func(r *http.Request) string {
+		return tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	}
+	for name, newStore := range newStores {
+		name, newStore := name, newStore
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			logger := greener.NewDefaultLogger(log.Printf)
+			perIP, err := greener.NewRateLimiter(logger, newStore("ratelimit_"+name+"_ip"), greener.RateLimit{Rate: 0.5, Burst: 11}, greener.RateLimitByIP)
+			if err != nil {
+				t.Fatal(err)
+			}
+			perIdentity, err := greener.NewRateLimiter(logger, newStore("ratelimit_"+name+"_identity"), greener.RateLimit{Rate: 5, Burst: 3}, greener.RateLimitByIdentity(verify))
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := perIP.Middleware(perIdentity.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("OK"))
+			})))
+			request := func(credentials string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				if credentials != "" {
+					req.Header.Set("Authorization", "Bearer "+credentials)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				return rec
+			}
+			for i := 0; i < 3; i++ {
+				if rec := request("alice-token"); rec.Code != http.StatusOK {
+					t.Fatalf("Request %d within the burst was rejected with %d", i, rec.Code)
+				}
+			}
+			rec := request("alice-token")
+			if rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("Expected 429, got %d", rec.Code)
+			}
+			if seconds, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || seconds != 1 {
+				t.Fatalf("Unexpected Retry-After %q", rec.Header().Get("Retry-After"))
+			}
+			// Credentials that don't verify share the IP's bucket however many different ones are made up
+			for i := 0; i < 4; i++ {
+				rec := request(fmt.Sprintf("made-up-%d", i))
+				if expected := http.StatusOK; i == 3 {
+					expected = http.StatusTooManyRequests
+					if rec.Code != expected {
+						t.Fatalf("Expected made up credentials not to get a fresh bucket, got %d", rec.Code)
+					}
+				} else if rec.Code != expected {
+					t.Fatalf("Unexpected status %d for unverified request %d", rec.Code, i)
+				}
+			}
+			if rec := request(""); rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("Expected requests without credentials to share the IP's bucket, got %d", rec.Code)
+			}
+			if rec := request("bob-token"); rec.Code != http.StatusOK {
+				t.Fatalf("Expected another identity to have its own bucket, got %d", rec.Code)
+			}
+			time.Sleep(250 * time.Millisecond)
+			if rec := request("alice-token"); rec.Code != http.StatusOK {
+				t.Fatalf("Expected the bucket to have refilled, got %d", rec.Code)
+			}
+			// The per-IP limit refills much more slowly, and caps the address however many identities it uses
+			if rec := request("carol-token"); rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("Expected the per-IP limit to apply, got %d", rec.Code)
+			}
+		})
+	}
+
+	t.Run("Invalid limits", func(t *testing.T) {
+		for _, limit := range []greener.RateLimit{{Rate: 0, Burst: 1}, {Rate: -1, Burst: 1}, {Rate: 1, Burst: 0}} {
+			if _, err := greener.NewRateLimiter(greener.NewDefaultLogger(log.Printf), greener.NewMemoryRateLimiterStore(), limit, greener.RateLimitByIP); err == nil {
+				t.Fatalf("Expected %+v to be rejected", limit)
+			}
+			for name, newStore := range newStores {
+				if _, _, err := newStore("ratelimit_invalid").Allow(ctx, "key", limit); err == nil {
+					t.Fatalf("Expected the %s store to reject %+v", name, limit)
+				}
+			}
+		}
+	})
+}
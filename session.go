@@ -0,0 +1,342 @@
+package greener
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SessionOptions configures a SessionManager. The zero value gives sensible defaults.
+type SessionOptions struct {
+	// CookieName defaults to "session".
+	CookieName string
+	// Partition is the KV partition sessions are stored in. Defaults to "session".
+	Partition string
+	// IdleTimeout is how long a session lasts without being used. Each request that uses the session pushes its expiry back, but to avoid a write on every request the expiry is only refreshed once a tenth of the timeout has passed. Defaults to 24 hours.
+	IdleTimeout time.Duration
+	// Path defaults to "/".
+	Path   string
+	Domain string
+	// Insecure leaves the Secure flag off the cookie so that sessions work over plain HTTP during local development.
+	Insecure bool
+	// SameSite defaults to http.SameSiteLaxMode.
+	SameSite http.SameSite
+	// Logger receives errors saving sessions. Defaults to the standard library log package.
+	Logger Logger
+}
+
+func (o SessionOptions) withDefaults() SessionOptions {
+	if o.CookieName == "" {
+		o.CookieName = "session"
+	}
+	if o.Partition == "" {
+		o.Partition = "session"
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = 24 * time.Hour
+	}
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	if o.SameSite == 0 {
+		o.SameSite = http.SameSiteLaxMode
+	}
+	if o.Logger == nil {
+		o.Logger = NewDefaultLogger(log.Printf)
+	}
+	return o
+}
+
+// Session holds the data for one visitor. Values are strings or float64s, as in a JSONValue. A Session is safe for concurrent use.
+type Session struct {
+	mu        sync.Mutex
+	id        string
+	oldID     string
+	data      JSONValue
+	expires   time.Time
+	changed   bool
+	destroyed bool
+}
+
+type sessionContextKey struct{}
+
+// SessionFromContext returns the session added by SessionManager.Middleware, or nil if there isn't one.
+func SessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionContextKey{}).(*Session)
+	return s
+}
+
+// ID returns the session ID, which is empty until something has been stored in a new session.
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+// Get returns the value stored under key, or nil.
+func (s *Session) Get(key string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[key]
+}
+
+// GetString returns the string stored under key, or "" if there isn't one.
+func (s *Session) GetString(key string) string {
+	value, _ := s.Get(key).(string)
+	return value
+}
+
+// Set stores value under key. The value must be a string or a float64.
+func (s *Session) Set(key string, value interface{}) error {
+	switch value.(type) {
+	case string, float64:
+	default:
+		return fmt.Errorf("session values must be strings or float64s, not %T", value)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = value
+	s.changed = true
+	s.destroyed = false
+	return nil
+}
+
+// Delete removes key from the session.
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[key]; ok {
+		delete(s.data, key)
+		s.changed = true
+	}
+}
+
+// RenewID gives the session a new ID while keeping its data. Call it whenever the visitor's privileges change, such as on login or logout, so that an ID captured beforehand can't be used to take over the session.
+func (s *Session) RenewID() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.oldID == "" {
+		s.oldID = s.id
+	}
+	s.id = ""
+	s.changed = true
+}
+
+// Destroy removes all the session's data and expires the cookie. If anything is set afterwards, it is saved in a new session with a new ID.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.oldID == "" {
+		s.oldID = s.id
+	}
+	s.id = ""
+	s.data = JSONValue{}
+	s.destroyed = true
+	s.changed = true
+}
+
+// SessionManager loads and saves sessions in a KV. Session IDs are random and only a hash of each ID is stored, so the database alone isn't enough to take over a session.
+type SessionManager struct {
+	kv   *KV
+	opts SessionOptions
+}
+
+// NewSessionManager creates a SessionManager that stores sessions in kv.
+func NewSessionManager(kv *KV, opts SessionOptions) *SessionManager {
+	return &SessionManager{kv: kv, opts: opts.withDefaults()}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func sessionKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// load returns the session for the request's cookie, or a new empty session if there isn't a valid one. IDs the server didn't issue are never adopted.
+func (m *SessionManager) load(r *http.Request) (*Session, error) {
+	s := &Session{data: JSONValue{}}
+	cookie, err := r.Cookie(m.opts.CookieName)
+	if err != nil || cookie.Value == "" {
+		return s, nil
+	}
+	data, expires, err := m.kv.Get(r.Context(), m.opts.Partition, sessionKey(cookie.Value))
+	if errors.Is(err, ErrKVNotFound) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.id = cookie.Value
+	s.data = data
+	if expires != nil {
+		s.expires = *expires
+	}
+	return s, nil
+}
+
+// save writes the session if it has changed or its expiry is due to be refreshed, returning the cookie to send, or nil if the cookie doesn't need to change.
+func (m *SessionManager) save(ctx context.Context, s *Session) (*http.Cookie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.destroyed {
+		oldID := s.oldID
+		s.oldID, s.changed, s.destroyed = "", false, false
+		if oldID == "" {
+			return nil, nil
+		}
+		if err := m.kv.Delete(ctx, m.opts.Partition, sessionKey(oldID)); err != nil {
+			return nil, err
+		}
+		return m.cookie("", -1), nil
+	}
+	if s.id == "" && len(s.data) == 0 {
+		// Nothing worth remembering, so don't create a session for every anonymous visitor
+		return nil, nil
+	}
+	refresh := s.expires.Sub(now) < m.opts.IdleTimeout-m.opts.IdleTimeout/10
+	if !s.changed && !refresh {
+		return nil, nil
+	}
+	if s.id == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return nil, err
+		}
+		s.id = id
+	}
+	expires := now.Add(m.opts.IdleTimeout).Truncate(time.Millisecond)
+	if err := m.write(ctx, s.oldID, s.id, s.data, expires); err != nil {
+		return nil, err
+	}
+	s.oldID = ""
+	s.expires = expires
+	s.changed = false
+	return m.cookie(s.id, int(m.opts.IdleTimeout/time.Second)), nil
+}
+
+// write stores the session under its new ID and removes any old one in the same transaction, so that a renewed ID never leaves both IDs valid.
+func (m *SessionManager) write(ctx context.Context, oldID, id string, data JSONValue, expires time.Time) error {
+	tableName := m.kv.table
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error encoding session to JSON: %w", err)
+	}
+	err = m.kv.db.Write(func(writeDB WriteDBHandler) error {
+		if oldID != "" {
+			if _, err := writeDB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE pk = ? AND sk = ?", tableName), m.opts.Partition, sessionKey(oldID)); err != nil {
+				return fmt.Errorf("failed to delete old session: %w", err)
+			}
+		}
+		_, err := writeDB.ExecContext(ctx, fmt.Sprintf(`
+		    INSERT INTO %s (pk, sk, data, expires) VALUES (?, ?, ?, ?)
+		    ON CONFLICT(pk, sk) DO UPDATE SET data=excluded.data, expires=excluded.expires;
+		`, tableName), m.opts.Partition, sessionKey(id), jsonData, expiresToDB(&expires))
+		if err != nil {
+			return fmt.Errorf("failed to write session: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var events []KVEvent
+	if oldID != "" {
+		events = append(events, KVEvent{Type: KVEventDelete, PK: m.opts.Partition, SK: sessionKey(oldID)})
+	}
+	events = append(events, KVEvent{Type: KVEventPut, PK: m.opts.Partition, SK: sessionKey(id), Data: data, Expires: &expires})
+	m.kv.committed(events...)
+	return nil
+}
+
+func (m *SessionManager) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     m.opts.CookieName,
+		Value:    value,
+		Path:     m.opts.Path,
+		Domain:   m.opts.Domain,
+		MaxAge:   maxAge,
+		Secure:   !m.opts.Insecure,
+		HttpOnly: true,
+		SameSite: m.opts.SameSite,
+	}
+}
+
+// sessionResponseWriter saves the session just before the response starts, since the cookie has to be sent with the headers.
+type sessionResponseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	manager *SessionManager
+	session *Session
+	saved   bool
+}
+
+func (w *sessionResponseWriter) saveSession() {
+	if w.saved {
+		return
+	}
+	w.saved = true
+	cookie, err := w.manager.save(w.ctx, w.session)
+	if err != nil {
+		w.manager.opts.Logger.Logf("Failed to save session: %v", err)
+		return
+	}
+	if cookie != nil {
+		http.SetCookie(w.ResponseWriter, cookie)
+		w.Header().Add("Vary", "Cookie")
+	}
+}
+
+func (w *sessionResponseWriter) WriteHeader(status int) {
+	w.saveSession()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sessionResponseWriter) Write(b []byte) (int, error) {
+	w.saveSession()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *sessionResponseWriter) Flush() {
+	w.saveSession()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *sessionResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware loads the session for each request, makes it available through SessionFromContext, and saves it before the response is written. Changes made after the handler has started writing the response are not saved.
+func (m *SessionManager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := m.load(r)
+		if err != nil {
+			m.opts.Logger.Logf("Failed to load session: %v", err)
+			http.Error(w, "Failed to load session", http.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithValue(r.Context(), sessionContextKey{}, s)
+		sw := &sessionResponseWriter{ResponseWriter: w, ctx: ctx, manager: m, session: s}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		sw.saveSession()
+	})
+}
@@ -0,0 +1,109 @@
+package greener_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/thejimmyg/greener"
+)
+
+func TestSessionManager(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(func() {
+		cancel()
+	})
+	kv, err := greener.NewKV(ctx, newTestBatchDB(t, "sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := greener.NewSessionManager(kv, greener.SessionOptions{IdleTimeout: time.Hour})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		s := greener.SessionFromContext(r.Context())
+		s.RenewID()
+		if err := s.Set("user", r.URL.Query().Get("user")); err != nil {
+			t.Errorf("Set failed: %v", err)
+		}
+		w.Write([]byte("logged in"))
+	})
+	mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(greener.SessionFromContext(r.Context()).GetString("user")))
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		greener.SessionFromContext(r.Context()).Destroy()
+	})
+	handler := manager.Middleware(mux)
+
+	request := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	sessionCookie := func(rec *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "session" {
+				return c
+			}
+		}
+		return nil
+	}
+
+	t.Run("Anonymous requests don't create sessions", func(t *testing.T) {
+		rec := request("/whoami", nil)
+		if sessionCookie(rec) != nil {
+			t.Fatalf("Expected no cookie for an empty session")
+		}
+	})
+
+	t.Run("Login, rotation and logout", func(t *testing.T) {
+		rec := request("/login?user=ann", nil)
+		first := sessionCookie(rec)
+		if first == nil {
+			t.Fatalf("Expected a session cookie")
+		}
+		if !first.Secure || !first.HttpOnly || first.SameSite != http.SameSiteLaxMode || first.MaxAge != 3600 {
+			t.Fatalf("Unexpected cookie attributes %+v", first)
+		}
+		if body := request("/whoami", first).Body.String(); body != "ann" {
+			t.Fatalf("Expected the session to remember the user, got %q", body)
+		}
+
+		rec = request("/login?user=bob", first)
+		second := sessionCookie(rec)
+		if second == nil || second.Value == first.Value {
+			t.Fatalf("Expected the session ID to be rotated")
+		}
+		if body := request("/whoami", first).Body.String(); body != "" {
+			t.Fatalf("Expected the old ID to be invalid, got %q", body)
+		}
+		if body := request("/whoami", second).Body.String(); body != "bob" {
+			t.Fatalf("Expected the new ID to work, got %q", body)
+		}
+
+		rec = request("/logout", second)
+		if c := sessionCookie(rec); c == nil || c.MaxAge >= 0 {
+			t.Fatalf("Expected the cookie to be expired, got %+v", c)
+		}
+		if body := request("/whoami", second).Body.String(); body != "" {
+			t.Fatalf("Expected the session to be destroyed, got %q", body)
+		}
+	})
+
+	t.Run("Unknown IDs are not adopted", func(t *testing.T) {
+		forged := &http.Cookie{Name: "session", Value: "chosen-by-attacker"}
+		rec := request("/login?user=eve", forged)
+		if c := sessionCookie(rec); c == nil || c.Value == forged.Value {
+			t.Fatalf("Expected a fresh server generated ID, got %+v", c)
+		}
+	})
+}